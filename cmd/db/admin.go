@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// handleHealth answers 200 as long as the database serves requests. The
+// body reports "degraded" with the error while compaction keeps failing,
+// as dead space then grows without bound, and while a follower cannot
+// reach its leader.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		Status           string `json:"status"`
+		CompactionError  string `json:"compactionError,omitempty"`
+		ReplicationError string `json:"replicationError,omitempty"`
+	}{Status: "ok"}
+	for _, db := range allDbs() {
+		if err := db.Stats().CompactionError; err != nil {
+			response.Status = "degraded"
+			response.CompactionError = err.Error()
+		}
+	}
+	if replica != nil {
+		if err := replica.status().err; err != nil {
+			response.Status = "degraded"
+			response.ReplicationError = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// logCompaction is the OnCompaction hook of the database.
+func logCompaction(result datastore.CompactionResult) {
+	if result.Err != nil {
+		// Failures are logged by the datastore itself.
+		return
+	}
+	log.Printf("Compacted %d segments in %v: %d -> %d bytes, %d records kept, %d dropped",
+		result.Segments, result.Duration.Round(time.Millisecond), result.BytesBefore, result.BytesAfter,
+		result.RecordsKept, result.RecordsDropped)
+}
+
+// handleBackup streams a tar archive of a consistent snapshot of the
+// database. Extracted into an empty directory it is a data directory that
+// cmd/db can be started on.
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := fmt.Sprintf("dbdata-%s.tar", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	// The status line is gone by the time the copy could fail, so a failed
+	// backup only shows up as a truncated archive.
+	if err := db.Backup(w); err != nil {
+		log.Printf("Backup failed: %v", err)
+	}
+}
+
+// handleCompact reports the compaction status on GET. POST compacts the
+// whole database, shard by shard, and reports the status once done; the
+// compaction is abandoned if the client goes away.
+func handleCompact(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var err error
+		for _, db := range allDbs() {
+			if err = db.Compact(r.Context()); err != nil {
+				break
+			}
+		}
+		switch {
+		case errors.Is(err, datastore.ErrCompactionRunning), errors.Is(err, datastore.ErrCompactionPaused):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, datastore.ErrReadOnly):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			log.Printf("Compaction failed: %v", err)
+			http.Error(w, "Compaction failed", http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeCompactionStatus(w)
+}
+
+// handleCompactSwitch pauses or resumes compaction on POST and reports the
+// resulting status.
+func handleCompactSwitch(set func(*datastore.Db)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		for _, db := range allDbs() {
+			set(db)
+		}
+		writeCompactionStatus(w)
+	}
+}
+
+// writeCompactionStatus writes the compaction status of the database, or
+// an array of them, one per shard, when sharded.
+func writeCompactionStatus(w http.ResponseWriter) {
+	var response any
+	if shards == nil {
+		response = newCompactionStatus(db)
+	} else {
+		statuses := make([]compactionStatus, len(shards))
+		for i, db := range shards {
+			statuses[i] = newCompactionStatus(db)
+		}
+		response = statuses
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+type compactionStatus struct {
+	Running       bool    `json:"running"`
+	Paused        bool    `json:"paused"`
+	InWindow      bool    `json:"inWindow"`
+	DirtySegments int     `json:"dirtySegments"`
+	Segments      int     `json:"segments"`
+	Size          int64   `json:"size"`
+	DeadBytes     int64   `json:"deadBytes"`
+	GarbageRatio  float64 `json:"garbageRatio"`
+
+	Compactions        int               `json:"compactions"`
+	CompactionFailures int               `json:"compactionFailures"`
+	LastCompaction     *compactionResult `json:"lastCompaction,omitempty"`
+	CompactionError    string            `json:"compactionError,omitempty"`
+}
+
+func newCompactionStatus(db *datastore.Db) compactionStatus {
+	status := db.CompactionStatus()
+	stats := db.Stats()
+	response := compactionStatus{
+		Running:       status.Running,
+		Paused:        status.Paused,
+		InWindow:      status.InWindow,
+		DirtySegments: status.DirtySegments,
+		Segments:      len(stats.Segments),
+		Size:          stats.Size,
+		DeadBytes:     stats.DeadBytes(),
+		GarbageRatio:  stats.GarbageRatio(),
+
+		Compactions:        stats.Compactions,
+		CompactionFailures: stats.CompactionFailures,
+	}
+	if last := stats.LastCompaction; last != nil {
+		response.LastCompaction = &compactionResult{
+			Start:          last.Start,
+			Duration:       last.Duration.String(),
+			Segments:       last.Segments,
+			BytesBefore:    last.BytesBefore,
+			BytesAfter:     last.BytesAfter,
+			RecordsKept:    last.RecordsKept,
+			RecordsDropped: last.RecordsDropped,
+		}
+		if last.Err != nil {
+			response.LastCompaction.Error = last.Err.Error()
+		}
+	}
+	if stats.CompactionError != nil {
+		response.CompactionError = stats.CompactionError.Error()
+	}
+	return response
+}
+
+type compactionResult struct {
+	Start          time.Time `json:"start"`
+	Duration       string    `json:"duration"`
+	Segments       int       `json:"segments"`
+	BytesBefore    int64     `json:"bytesBefore"`
+	BytesAfter     int64     `json:"bytesAfter"`
+	RecordsKept    int       `json:"recordsKept"`
+	RecordsDropped int       `json:"recordsDropped"`
+	Error          string    `json:"error,omitempty"`
+}
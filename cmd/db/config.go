@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// Every flag can also be set through the environment variable named in its
+// usage; an explicit flag wins.
+var (
+	dbDir = flag.String("dir", envString("DB_DIR", "/app/dbdata"),
+		"data directory (DB_DIR)")
+	maxSegmentSize = flag.Int64("max-segment-size", envInt64("DB_MAX_SEGMENT_SIZE", 0),
+		"segment size in bytes past which a new segment is started, 0 for the default (DB_MAX_SEGMENT_SIZE)")
+	compactionThreshold = flag.Int("compaction-threshold", int(envInt64("DB_COMPACTION_THRESHOLD", 0)),
+		"number of dirty sealed segments that triggers compaction, 0 for the default (DB_COMPACTION_THRESHOLD)")
+	garbageRatio = flag.Float64("garbage-ratio", envFloat64("DB_GARBAGE_RATIO", 0),
+		"fraction of dead bytes that makes a sealed segment dirty, 0 for the default (DB_GARBAGE_RATIO)")
+	compactionWindows = flag.String("compaction-windows", envString("DB_COMPACTION_WINDOWS", ""),
+		"comma-separated hh:mm-hh:mm local times automatic compaction is restricted to, empty for any time (DB_COMPACTION_WINDOWS)")
+	compactionInterval = flag.Duration("compaction-interval", envDuration("DB_COMPACTION_INTERVAL", time.Minute),
+		"how often dirty segments are looked for inside a compaction window (DB_COMPACTION_INTERVAL)")
+	compressionThreshold = flag.Int("compression-threshold", int(envInt64("DB_COMPRESSION_THRESHOLD", 0)),
+		"value size in bytes from which values are stored compressed, 0 to disable (DB_COMPRESSION_THRESHOLD)")
+	mmap = flag.Bool("mmap", envBool("DB_MMAP", false),
+		"serve reads of sealed segments from memory maps where supported (DB_MMAP)")
+	fileMode = flag.String("file-mode", envString("DB_FILE_MODE", "0600"),
+		"octal permission of created data files (DB_FILE_MODE)")
+	syncMode = flag.String("sync", envString("DB_SYNC", datastore.SyncAlways.String()),
+		"when writes are fsynced: always, group, periodic or none (DB_SYNC)")
+	syncDelay = flag.Duration("sync-delay", envDuration("DB_SYNC_DELAY", 0),
+		"how long a group commit may wait for more writers (DB_SYNC_DELAY)")
+	syncInterval = flag.Duration("sync-interval", envDuration("DB_SYNC_INTERVAL", time.Second),
+		"fsync period of the periodic sync mode (DB_SYNC_INTERVAL)")
+	readOnly = flag.Bool("read-only", envBool("DB_READ_ONLY", false),
+		"open the data directory for reading only (DB_READ_ONLY)")
+	recoverDamage = flag.Bool("recover", envBool("DB_RECOVER", false),
+		"open despite damaged segments, cutting off a torn tail and skipping damaged records (DB_RECOVER)")
+	follow = flag.String("follow", envString("DB_FOLLOW", ""),
+		"URL of a leader to replicate from; the database is read-only until promoted (DB_FOLLOW)")
+	shardCount = flag.Int("shards", int(envInt64("DB_SHARDS", 0)),
+		"number of shards to split the data directory into, 0 for none (DB_SHARDS)")
+	refreshInterval = flag.Duration("refresh-interval", envDuration("DB_REFRESH_INTERVAL", time.Second),
+		"how often a read-only database picks up new writes, 0 to never (DB_REFRESH_INTERVAL)")
+)
+
+func dbOptions() datastore.Options {
+	mode, err := datastore.ParseSyncMode(*syncMode)
+	if err != nil {
+		log.Fatalf("Invalid sync mode: %v", err)
+	}
+	perm, err := strconv.ParseUint(*fileMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid file mode %q: %v", *fileMode, err)
+	}
+	var windows []datastore.CompactionWindow
+	for _, spec := range strings.Split(*compactionWindows, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		window, err := datastore.ParseCompactionWindow(spec)
+		if err != nil {
+			log.Fatalf("Invalid compaction windows: %v", err)
+		}
+		windows = append(windows, window)
+	}
+
+	return datastore.Options{
+		MaxSegmentSize:       *maxSegmentSize,
+		CompactionThreshold:  *compactionThreshold,
+		GarbageRatio:         *garbageRatio,
+		CompactionWindows:    windows,
+		CompactionInterval:   *compactionInterval,
+		CompressionThreshold: *compressionThreshold,
+		MMap:                 *mmap,
+		FileMode:             os.FileMode(perm),
+		ReadOnly:             *readOnly,
+		RefreshInterval:      *refreshInterval,
+		Recover:              *recoverDamage,
+		Logger:               log.Default(),
+		OnCompaction:         logCompaction,
+		Sync:                 mode,
+		MaxSyncDelay:         *syncDelay,
+		SyncInterval:         *syncInterval,
+	}
+}
+
+func envString(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+func envInt64(name string, def int64) int64 {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return parsed
+}
+
+func envFloat64(name string, def float64) float64 {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return parsed
+}
+
+func envBool(name string, def bool) bool {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return parsed
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return parsed
+}
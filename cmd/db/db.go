@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,44 +18,66 @@ import (
 )
 
 const (
-	defaultPort  = "8070"
-	dbDir        = "/app/dbdata"
-	dbServiceURL = "http://db:8070/db/"
-	teamName     = "wholelottago"
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	batchKey         = "_batch"
+	incrSuffix       = "/incr"
+)
+
+const (
+	defaultPort = "8070"
+	teamName    = "wholelottago"
 )
 
 var db *datastore.Db
 
-func waitForDB() error {
-	timeout := time.After(10 * time.Second)
-	tick := time.Tick(500 * time.Millisecond)
-
-	for {
-		select {
-		case <-timeout:
-			return fmt.Errorf("DB service timeout")
-		case <-tick:
-			resp, err := http.Get(dbServiceURL + "health")
-			if err == nil && resp.StatusCode == http.StatusOK {
-				return nil
-			}
+func main() {
+	flag.Parse()
+
+	opts := dbOptions()
+	if *follow != "" {
+		// A follower starts out empty and mirrors its leader.
+		if err := os.MkdirAll(*dbDir, 0o755); err != nil {
+			log.Fatalf("Failed to create data directory: %v", err)
 		}
+		opts.ReadOnly = true
+		opts.RefreshInterval = 0
 	}
-}
 
-func main() {
 	var err error
-
-	db, err = datastore.Open(dbDir)
+	if *shardCount > 0 {
+		if *follow != "" {
+			log.Fatal("Replication is not supported with shards")
+		}
+		shards, err = datastore.OpenShards(*dbDir, *shardCount, opts)
+		if errors.Is(err, datastore.ErrShardCount) || errors.Is(err, datastore.ErrUnsharded) {
+			log.Fatalf("Failed to open database: %v; move the keys with dbtool reshard", err)
+		}
+		if err == nil {
+			log.Printf("Serving %d shards", len(shards))
+		}
+	} else {
+		db, err = datastore.OpenWithOptions(*dbDir, opts)
+	}
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
+	if *follow != "" {
+		replica = startFollower(*follow)
+		log.Printf("Following %s", *follow)
+	}
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	http.HandleFunc("/health", handleHealth)
 
 	http.HandleFunc("/db/", dbHandler)
+	http.HandleFunc("/admin/backup", handleUnsharded(handleBackup))
+	http.HandleFunc("/admin/compact", handleCompact)
+	http.HandleFunc("/admin/compact/pause", handleCompactSwitch((*datastore.Db).PauseCompaction))
+	http.HandleFunc("/admin/compact/resume", handleCompactSwitch((*datastore.Db).ResumeCompaction))
+	http.HandleFunc("/admin/replication", handleUnsharded(handleReplicationStatus))
+	http.HandleFunc("/admin/replication/state", handleUnsharded(handleReplicationState))
+	http.HandleFunc(segmentsPath, handleUnsharded(handleReplicationSegment))
+	http.HandleFunc("/admin/promote", handleUnsharded(handlePromote))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -61,22 +88,6 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
 
-func initDB() {
-	var err error
-
-	db, err = datastore.Open(dbDir)
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
-	}
-
-	go func() {
-		if err := waitForDB(); err != nil {
-			log.Printf("Failed to wait for DB: %v", err)
-			return
-		}
-	}()
-}
-
 func dbHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/db/") {
@@ -85,53 +96,105 @@ func dbHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	key := strings.TrimPrefix(path, "/db/")
 	if key == "" {
+		if r.Method == http.MethodGet {
+			handleList(w, r)
+			return
+		}
 		http.Error(w, "Key is required", http.StatusBadRequest)
 		return
 	}
 
+	if r.Method != http.MethodGet && allDbs()[0].ReadOnly() {
+		http.Error(w, "Database is read-only", http.StatusForbidden)
+		return
+	}
+
+	if key == watchKey && r.Method == http.MethodGet {
+		handleWatch(w, r)
+		return
+	}
+
+	if key == batchKey {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		handleBatch(w, r)
+		return
+	}
+
+	if strings.HasSuffix(key, incrSuffix) && r.Method == http.MethodPost {
+		key = strings.TrimSuffix(key, incrSuffix)
+		if reservedKey(key) {
+			http.Error(w, "Key is reserved", http.StatusBadRequest)
+			return
+		}
+		handleIncrement(w, r, key)
+		return
+	}
+
+	if reservedKey(key) {
+		http.Error(w, "Key is reserved", http.StatusBadRequest)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		handleGet(w, r, key)
 	case http.MethodPost:
 		handlePost(w, r, key)
+	case http.MethodDelete:
+		handleDelete(w, r, key)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// reservedKey reports whether key is taken by an endpoint under /db/. Such
+// a key could only be read or only be written through the API, so it is
+// rejected altogether.
+func reservedKey(key string) bool {
+	return key == watchKey || key == batchKey || strings.HasSuffix(key, incrSuffix)
+}
+
 func handleGet(w http.ResponseWriter, r *http.Request, key string) {
 	dataType := r.URL.Query().Get("type")
-	if dataType == "" {
-		dataType = "string"
-	}
-
-	var value interface{}
-	var err error
-
-	switch dataType {
-	case "string":
-		value, err = db.Get(key)
-	case "int64":
-		value, err = db.GetInt64(key)
-	default:
+	if dataType != "" && !knownType(dataType) {
 		http.Error(w, "Invalid type parameter", http.StatusBadRequest)
 		return
 	}
 
+	entry, err := dbFor(key).GetEntry(key)
 	if err != nil {
-		if err == datastore.ErrNotFound {
+		if errors.Is(err, datastore.ErrNotFound) {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
 		return
 	}
+	if dataType != "" && dataType != entry.Type.String() {
+		http.Error(w, "Value is not of the requested type", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("ETag", etag(entry.Seq))
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		wildcard, seqs := parseETags(header, true)
+		if wildcard || slices.Contains(seqs, entry.Seq) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	value := entry.Value
 
 	response := struct {
 		Key   string      `json:"key"`
+		Type  string      `json:"type"`
 		Value interface{} `json:"value"`
 	}{
 		Key:   key,
+		Type:  valueType(value),
 		Value: value,
 	}
 
@@ -143,7 +206,13 @@ func handleGet(w http.ResponseWriter, r *http.Request, key string) {
 
 func handlePost(w http.ResponseWriter, r *http.Request, key string) {
 	var request struct {
-		Value interface{} `json:"value"`
+		Value json.RawMessage `json:"value"`
+		// TTL is a duration such as "30s" or "1h" after which the key
+		// expires. Keys without one never do.
+		TTL string `json:"ttl"`
+		// Expect makes the write conditional on the current value, which
+		// must equal it; null means the key must not exist yet.
+		Expect json.RawMessage `json:"expect"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -151,21 +220,239 @@ func handlePost(w http.ResponseWriter, r *http.Request, key string) {
 		return
 	}
 
-	var err error
-	switch v := request.Value.(type) {
-	case string:
-		err = db.Put(key, v)
-	case float64: // JSON numbers decode as float64
-		err = db.PutInt64(key, int64(v))
-	default:
-		http.Error(w, "Unsupported value type", http.StatusBadRequest)
+	var ttl time.Duration
+	if request.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(request.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	dataType := r.URL.Query().Get("type")
+	value, err := decodeValue(request.Value, dataType)
+	if err != nil {
+		http.Error(w, "Unsupported value: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Expect != nil {
+		if ttl > 0 || hasPrecondition(r) {
+			http.Error(w, "expect cannot be combined with ttl or If-Match/If-None-Match", http.StatusBadRequest)
+			return
+		}
+		handleCompareAndSwap(w, key, request.Expect, dataType, value)
+		return
+	}
+
+	pre, ok := precondition(r)
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	seq, err := dbFor(key).PutValueIf(key, value, ttl, pre)
+	if err != nil {
+		if errors.Is(err, datastore.ErrPreconditionFailed) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		} else {
+			http.Error(w, "Failed to store data", http.StatusInternalServerError)
+		}
 		return
 	}
 
+	w.Header().Set("ETag", etag(seq))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleCompareAndSwap stores value only if the current value of key
+// matches expect, answering 412 Precondition Failed otherwise.
+func handleCompareAndSwap(w http.ResponseWriter, key string, expect json.RawMessage, dataType string, value any) {
+	var old any
+	if string(bytes.TrimSpace(expect)) != "null" {
+		var err error
+		old, err = decodeValue(expect, dataType)
+		if err != nil {
+			http.Error(w, "Unsupported expect value: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	swapped, err := dbFor(key).CompareAndSwap(key, old, value)
 	if err != nil {
 		http.Error(w, "Failed to store data", http.StatusInternalServerError)
 		return
 	}
+	if !swapped {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleIncrement(w http.ResponseWriter, r *http.Request, key string) {
+	request := struct {
+		Delta int64 `json:"delta"`
+	}{
+		Delta: 1,
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	value, err := dbFor(key).IncrementInt64(key, request.Delta)
+	if err != nil {
+		if errors.Is(err, datastore.ErrTypeMismatch) {
+			http.Error(w, "Value is not an int64", http.StatusConflict)
+		} else {
+			http.Error(w, "Failed to store data", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	response := struct {
+		Key   string `json:"key"`
+		Type  string `json:"type"`
+		Value int64  `json:"value"`
+	}{
+		Key:   key,
+		Type:  valueType(value),
+		Value: value,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, key string) {
+	pre, ok := precondition(r)
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if err := dbFor(key).DeleteIf(key, pre); err != nil {
+		switch {
+		case errors.Is(err, datastore.ErrPreconditionFailed):
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case errors.Is(err, datastore.ErrNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			http.Error(w, "Failed to delete data", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	cursor := query.Get("cursor")
+
+	limit := defaultListLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	type item struct {
+		Key   string      `json:"key"`
+		Type  string      `json:"type"`
+		Value interface{} `json:"value"`
+	}
+	response := struct {
+		Items  []item `json:"items"`
+		Cursor string `json:"cursor,omitempty"`
+	}{
+		Items: []item{},
+	}
+
+	// The cursor is the last key of the previous page.
+	it := newPrefixIterator(prefix, cursor)
+	defer it.Close()
+
+	for it.Next() {
+		if len(response.Items) == limit {
+			response.Cursor = response.Items[limit-1].Key
+			break
+		}
+		response.Items = append(response.Items, item{Key: it.Key(), Type: valueType(it.Value()), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Ops []struct {
+			Op    string          `json:"op"`
+			Key   string          `json:"key"`
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"ops"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var batch datastore.Batch
+	var keys []string
+	for _, op := range request.Ops {
+		if op.Key == "" {
+			http.Error(w, "Key is required", http.StatusBadRequest)
+			return
+		}
+		if reservedKey(op.Key) {
+			http.Error(w, "Key is reserved", http.StatusBadRequest)
+			return
+		}
+		keys = append(keys, op.Key)
+		switch op.Op {
+		case "put":
+			value, err := decodeValue(op.Value, op.Type)
+			if err != nil {
+				http.Error(w, "Unsupported value: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := batch.PutValue(op.Key, value); err != nil {
+				http.Error(w, "Unsupported value: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		case "delete":
+			batch.Delete(op.Key)
+		default:
+			http.Error(w, "Unsupported operation", http.StatusBadRequest)
+			return
+		}
+	}
+
+	shard, err := batchShard(keys)
+	if err != nil {
+		http.Error(w, "Batch spans shards: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := shard.Write(&batch); err != nil {
+		http.Error(w, "Failed to store data", http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
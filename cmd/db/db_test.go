@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// useTestDb serves a fresh database for the duration of the test.
+func useTestDb(t *testing.T) *datastore.Db {
+	t.Helper()
+	return useTestDbWithOptions(t, t.TempDir(), datastore.Options{})
+}
+
+// useTestDbWithOptions serves the database in dir opened with opts for the
+// duration of the test.
+func useTestDbWithOptions(t *testing.T, dir string, opts datastore.Options) *datastore.Db {
+	t.Helper()
+	testDb, err := datastore.OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	db, shards = testDb, nil
+	t.Cleanup(func() {
+		testDb.Close()
+		db = nil
+	})
+	return testDb
+}
+
+// serve runs one request through dbHandler.
+func serve(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	dbHandler(rec, req)
+	return rec
+}
+
+func TestListPagination(t *testing.T) {
+	testDb := useTestDb(t)
+	for _, key := range []string{"a/1", "a/2", "a/3", "a/4", "a/5", "b/1"} {
+		if err := testDb.Put(key, "v"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("Expected paging to end, got keys %v", keys)
+		}
+		rec := serve(http.MethodGet, "/db/?prefix=a/&limit=2&cursor="+url.QueryEscape(cursor), "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var page struct {
+			Items []struct {
+				Key string `json:"key"`
+			} `json:"items"`
+			Cursor string `json:"cursor"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("Failed to decode page: %v", err)
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+	}
+	if expected := []string{"a/1", "a/2", "a/3", "a/4", "a/5"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected pages to list %v, got %v", expected, keys)
+	}
+
+	if rec := serve(http.MethodGet, "/db/?limit=0", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for limit=0, got %d", rec.Code)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	testDb := useTestDb(t)
+	if err := testDb.Put("gone", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	rec := serve(http.MethodPost, "/db/_batch", `{"ops":[
+		{"op":"put","key":"k1","value":"v1"},
+		{"op":"put","key":"k2","value":2},
+		{"op":"delete","key":"gone"}
+	]}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if value, err := testDb.Get("k1"); err != nil || value != "v1" {
+		t.Errorf("Expected k1 = v1, got %q, %v", value, err)
+	}
+	if value, err := testDb.GetInt64("k2"); err != nil || value != 2 {
+		t.Errorf("Expected k2 = 2, got %d, %v", value, err)
+	}
+	if _, err := testDb.Get("gone"); err != datastore.ErrNotFound {
+		t.Errorf("Expected gone to be deleted, got %v", err)
+	}
+
+	// A bad op rejects the whole batch.
+	rec = serve(http.MethodPost, "/db/_batch", `{"ops":[
+		{"op":"put","key":"k3","value":"v3"},
+		{"op":"rename","key":"k1"}
+	]}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown op, got %d", rec.Code)
+	}
+	if _, err := testDb.Get("k3"); err != datastore.ErrNotFound {
+		t.Errorf("Expected nothing of a rejected batch to be written, got %v", err)
+	}
+
+	if rec := serve(http.MethodPost, "/db/_batch", `{"ops":[{"op":"put","value":"v"}]}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an op without a key, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/db/_batch", "", nil); rec.Code == http.StatusOK {
+		t.Errorf("Expected GET of the batch endpoint to fail, got %d", rec.Code)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	testDb := useTestDb(t)
+
+	rec := serve(http.MethodPost, "/db/counter/incr", `{"delta":2}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the increment to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	if value, err := testDb.GetInt64("counter"); err != nil || value != 2 {
+		t.Errorf("Expected counter = 2, got %d, %v", value, err)
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+	}{
+		{http.MethodGet, "/db/a/incr", ""},
+		{http.MethodDelete, "/db/a/incr", ""},
+		{http.MethodPost, "/db/a/incr/incr", ""},
+		{http.MethodPost, "/db/_watch", `{"value":"v"}`},
+		{http.MethodDelete, "/db/_watch", ""},
+		{http.MethodPost, "/db/_watch/incr", ""},
+		{http.MethodPost, "/db/_batch/incr", ""},
+		{http.MethodPost, "/db/_batch", `{"ops":[{"op":"put","key":"_watch","value":"v"}]}`},
+		{http.MethodPost, "/db/_batch", `{"ops":[{"op":"put","key":"_batch","value":"v"}]}`},
+		{http.MethodPost, "/db/_batch", `{"ops":[{"op":"put","key":"a/incr","value":"v"}]}`},
+	} {
+		if rec := serve(tc.method, tc.target, tc.body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s %s, got %d", tc.method, tc.target, rec.Code)
+		}
+	}
+	if keys := testDb.Keys(""); !reflect.DeepEqual(keys, []string{"counter"}) {
+		t.Errorf("Expected no reserved key to be written, got %v", keys)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// etag formats the sequence number of a value as a strong entity tag.
+func etag(seq uint64) string {
+	return `"` + strconv.FormatUint(seq, 10) + `"`
+}
+
+// parseETags reads a list of entity tags as sent in If-Match and
+// If-None-Match. Tags that are not ours are skipped: they match nothing.
+// weak selects the weak comparison of If-None-Match, under which W/"1"
+// matches our "1"; If-Match compares strongly, so weak tags never match.
+func parseETags(header string, weak bool) (wildcard bool, seqs []uint64) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			wildcard = true
+			continue
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if !strings.HasPrefix(tag, `"`) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+		if err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	return wildcard, seqs
+}
+
+// precondition builds the datastore precondition of a write from its
+// If-Match and If-None-Match headers. ok is false when If-Match can never
+// hold because it lists no tag of ours.
+func precondition(r *http.Request) (pre datastore.Precondition, ok bool) {
+	if header := r.Header.Get("If-Match"); header != "" {
+		wildcard, seqs := parseETags(header, false)
+		if !wildcard && len(seqs) == 0 {
+			return pre, false
+		}
+		pre.MustExist = wildcard
+		pre.IfMatch = seqs
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		wildcard, seqs := parseETags(header, true)
+		pre.MustNotExist = wildcard
+		pre.IfNoneMatch = seqs
+	}
+	return pre, true
+}
+
+// hasPrecondition reports whether the request makes its write conditional
+// through headers.
+func hasPrecondition(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestETags(t *testing.T) {
+	useTestDb(t)
+
+	rec := serve(http.MethodPost, "/db/k", `{"value":"v1"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	tag := rec.Header().Get("ETag")
+	if tag == "" {
+		t.Fatalf("Expected the write to return an ETag")
+	}
+
+	rec = serve(http.MethodGet, "/db/k", "", nil)
+	if got := rec.Header().Get("ETag"); got != tag {
+		t.Errorf("Expected GET to return ETag %s, got %s", tag, got)
+	}
+	if rec := serve(http.MethodGet, "/db/k", "", http.Header{"If-None-Match": {tag}}); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d", rec.Code)
+	}
+
+	if rec := serve(http.MethodPost, "/db/k", `{"value":"v2"}`, http.Header{"If-Match": {`"12345"`}}); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale If-Match, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPost, "/db/k", `{"value":"v2"}`, http.Header{"If-None-Match": {"*"}}); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for If-None-Match: * on an existing key, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodDelete, "/db/k", "", http.Header{"If-Match": {`"12345"`}}); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a delete with a stale If-Match, got %d", rec.Code)
+	}
+
+	if rec := serve(http.MethodGet, "/db/k", "", http.Header{"If-None-Match": {"W/" + tag}}); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a weak If-None-Match, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPost, "/db/k", `{"value":"v2"}`, http.Header{"If-Match": {"W/" + tag}}); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a weak If-Match, which compares strongly, got %d", rec.Code)
+	}
+
+	rec = serve(http.MethodPost, "/db/k", `{"value":"v2"}`, http.Header{"If-Match": {tag}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a matching If-Match, got %d", rec.Code)
+	}
+	if rec.Header().Get("ETag") == tag {
+		t.Errorf("Expected a new ETag after the write")
+	}
+	if rec := serve(http.MethodPost, "/db/k", `{"value":"v3"}`, http.Header{"If-Match": {tag}}); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for the ETag the last write replaced, got %d", rec.Code)
+	}
+}
+
+func TestParseETags(t *testing.T) {
+	cases := []struct {
+		header   string
+		weak     bool
+		wildcard bool
+		seqs     []uint64
+	}{
+		{`"1", "2"`, false, false, []uint64{1, 2}},
+		{`W/"1", "2"`, false, false, []uint64{2}},
+		{`W/"1", "2"`, true, false, []uint64{1, 2}},
+		{`*`, false, true, nil},
+		{`"x", 3`, true, false, nil},
+	}
+	for _, c := range cases {
+		wildcard, seqs := parseETags(c.header, c.weak)
+		if wildcard != c.wildcard || !reflect.DeepEqual(seqs, c.seqs) {
+			t.Errorf("parseETags(%q, %v) = %v, %v, expected %v, %v", c.header, c.weak, wildcard, seqs, c.wildcard, c.seqs)
+		}
+	}
+}
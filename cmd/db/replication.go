@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	segmentsPath = "/admin/replication/segments/"
+	// replicationWait is how long a follower waits for new writes on the
+	// leader before asking again.
+	replicationWait  = 10 * time.Second
+	replicationRetry = time.Second
+)
+
+// replica is the follower state when cmd/db follows a leader, nil on a
+// leader.
+var replica *follower
+
+// replicationState is datastore.ReplicationState on the wire.
+type replicationState struct {
+	Segments []segmentState `json:"segments"`
+	LastSeq  uint64         `json:"lastSeq"`
+}
+
+type segmentState struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// handleReplicationState answers a follower with the segment files of the
+// database. With after it waits up to wait, 10s by default, for writes
+// newer than that sequence number, so that followers do not have to poll.
+func handleReplicationState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if after := query.Get("after"); after != "" {
+		seq, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid after parameter", http.StatusBadRequest)
+			return
+		}
+		wait := replicationWait
+		if param := query.Get("wait"); param != "" {
+			wait, err = time.ParseDuration(param)
+			if err != nil || wait < 0 {
+				http.Error(w, "Invalid wait parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		waitForWrite(r.Context(), seq, wait)
+	}
+
+	state := db.ReplicationState()
+	var response replicationState
+	response.LastSeq = state.LastSeq
+	for _, seg := range state.Segments {
+		response.Segments = append(response.Segments, segmentState{seg.Name, seg.Size})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// waitForWrite returns once the database holds a write newer than seq, the
+// wait is over or ctx is done.
+func waitForWrite(ctx context.Context, seq uint64, wait time.Duration) {
+	sub := db.Subscribe("")
+	defer sub.Close()
+	if sub.StartSeq > seq {
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-sub.Changes():
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// handleReplicationSegment sends the byte range of a segment file given by
+// the offset and size query parameters.
+func handleReplicationSegment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, segmentsPath)
+	offset, err1 := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	size, err2 := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if name == "" || strings.Contains(name, "/") || err1 != nil || err2 != nil || offset < 0 || size < 0 {
+		http.Error(w, "Invalid segment range", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if err := db.CopySegment(w, name, offset, size); err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			w.Header().Del("Content-Length")
+			http.Error(w, "Segment not found", http.StatusNotFound)
+			return
+		}
+		// The follower notices the short body and tries again.
+		log.Printf("Failed to send segment %s: %v", name, err)
+	}
+}
+
+// handleReplicationStatus reports the role of this node and, on a
+// follower, how far it is behind its leader.
+func handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeReplicationStatus(w)
+}
+
+func writeReplicationStatus(w http.ResponseWriter) {
+	response := struct {
+		Role      string     `json:"role"`
+		LastSeq   uint64     `json:"lastSeq"`
+		Leader    string     `json:"leader,omitempty"`
+		LeaderSeq uint64     `json:"leaderSeq,omitempty"`
+		Lag       uint64     `json:"lag"`
+		LastSync  *time.Time `json:"lastSync,omitempty"`
+		Error     string     `json:"error,omitempty"`
+	}{
+		Role:    "leader",
+		LastSeq: db.LastSeq(),
+	}
+	if replica != nil {
+		status := replica.status()
+		if !status.promoted {
+			response.Role = "follower"
+			response.Leader = replica.leader
+			response.LeaderSeq = status.leaderSeq
+			if status.leaderSeq > response.LastSeq {
+				response.Lag = status.leaderSeq - response.LastSeq
+			}
+			if !status.lastSync.IsZero() {
+				response.LastSync = &status.lastSync
+			}
+			if status.err != nil {
+				response.Error = status.err.Error()
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// handlePromote turns a follower into a leader on POST: it stops following
+// and starts accepting writes. The old leader must be stopped first; two
+// leaders would each take writes the other never sees.
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if replica == nil {
+		http.Error(w, "Not a follower", http.StatusConflict)
+		return
+	}
+	if err := replica.promote(); err != nil {
+		log.Printf("Promotion failed: %v", err)
+		http.Error(w, "Promotion failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Promoted to leader, stopped following %s", replica.leader)
+	writeReplicationStatus(w)
+}
+
+// follower keeps the database in sync with a leader.
+type follower struct {
+	leader string
+	client *http.Client
+
+	mu        sync.Mutex
+	leaderSeq uint64
+	lastSync  time.Time
+	err       error
+	promoted  bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type followerStatus struct {
+	leaderSeq uint64
+	lastSync  time.Time
+	err       error
+	promoted  bool
+}
+
+func startFollower(leader string) *follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		leader: strings.TrimSuffix(leader, "/"),
+		// Long enough for a state request held for replicationWait.
+		client: &http.Client{Timeout: replicationWait + 30*time.Second},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go f.run(ctx)
+	return f
+}
+
+func (f *follower) run(ctx context.Context) {
+	defer close(f.done)
+	for ctx.Err() == nil {
+		state, err := f.fetchState(ctx, db.LastSeq())
+		if err == nil {
+			err = db.ApplyReplication(state, func(w io.Writer, name string, offset, size int64) error {
+				return f.fetchSegment(ctx, w, name, offset, size)
+			})
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		f.mu.Lock()
+		if err == nil {
+			f.leaderSeq = state.LastSeq
+			f.lastSync = time.Now()
+		} else if f.err == nil {
+			log.Printf("Replication from %s failed: %v", f.leader, err)
+		}
+		f.err = err
+		f.mu.Unlock()
+
+		if err != nil {
+			select {
+			case <-time.After(replicationRetry):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (f *follower) fetchState(ctx context.Context, after uint64) (datastore.ReplicationState, error) {
+	query := url.Values{
+		"after": {strconv.FormatUint(after, 10)},
+		"wait":  {replicationWait.String()},
+	}
+	var response replicationState
+	if err := f.get(ctx, "/admin/replication/state?"+query.Encode(), func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&response)
+	}); err != nil {
+		return datastore.ReplicationState{}, err
+	}
+
+	state := datastore.ReplicationState{LastSeq: response.LastSeq}
+	for _, seg := range response.Segments {
+		state.Segments = append(state.Segments, datastore.SegmentState{Name: seg.Name, Size: seg.Size})
+	}
+	return state, nil
+}
+
+func (f *follower) fetchSegment(ctx context.Context, w io.Writer, name string, offset, size int64) error {
+	query := url.Values{
+		"offset": {strconv.FormatInt(offset, 10)},
+		"size":   {strconv.FormatInt(size, 10)},
+	}
+	return f.get(ctx, segmentsPath+url.PathEscape(name)+"?"+query.Encode(), func(body io.Reader) error {
+		n, err := io.Copy(w, body)
+		if err == nil && n != size {
+			err = fmt.Errorf("segment %s: got %d bytes, expected %d", name, n, size)
+		}
+		return err
+	})
+}
+
+func (f *follower) get(ctx context.Context, path string, read func(io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return read(resp.Body)
+}
+
+func (f *follower) status() followerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return followerStatus{f.leaderSeq, f.lastSync, f.err, f.promoted}
+}
+
+// promote stops following and makes the database writable.
+func (f *follower) promote() error {
+	f.cancel()
+	<-f.done
+	if err := db.Promote(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.promoted = true
+	f.err = nil
+	return nil
+}
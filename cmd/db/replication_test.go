@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func getReplicationState(t *testing.T, query string) replicationState {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleReplicationState(rec, httptest.NewRequest(http.MethodGet, "/admin/replication/state"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var state replicationState
+	if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+		t.Fatalf("Failed to decode state: %v", err)
+	}
+	return state
+}
+
+func TestReplicationStateLongPoll(t *testing.T) {
+	testDb := useTestDb(t)
+	if err := testDb.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	seq := strconv.FormatUint(testDb.LastSeq(), 10)
+
+	start := time.Now()
+	if state := getReplicationState(t, "?after="+seq+"&wait=50ms"); strconv.FormatUint(state.LastSeq, 10) != seq {
+		t.Errorf("Expected lastSeq %s without new writes, got %d", seq, state.LastSeq)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the request to wait for a write, returned after %v", elapsed)
+	}
+
+	done := make(chan replicationState)
+	go func() {
+		done <- getReplicationState(t, "?after="+seq+"&wait=10s")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := testDb.Put("k2", "v2"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	select {
+	case state := <-done:
+		if state.LastSeq != testDb.LastSeq() || len(state.Segments) == 0 {
+			t.Errorf("Expected the state after the write, got %+v", state)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the request to return on the write")
+	}
+
+	rec := httptest.NewRecorder()
+	handleReplicationState(rec, httptest.NewRequest(http.MethodGet, "/admin/replication/state?after=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid after, got %d", rec.Code)
+	}
+}
+
+func TestReplicationSegment(t *testing.T) {
+	testDb := useTestDbWithOptions(t, t.TempDir(), datastore.Options{MaxSegmentSize: 100, CompactionThreshold: 100})
+	for _, key := range []string{"k1", "k2", "k3", "k1", "k2", "k3"} {
+		if err := testDb.Put(key, "value of "+key); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleReplicationSegment(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	before := getReplicationState(t, "")
+	first := before.Segments[0]
+	rec := get(segmentsPath + first.Name + "?offset=0&size=" + strconv.FormatInt(first.Size, 10))
+	if rec.Code != http.StatusOK || int64(rec.Body.Len()) != first.Size {
+		t.Errorf("Expected %d bytes of %s, got %d, %d bytes", first.Size, first.Name, rec.Code, rec.Body.Len())
+	}
+
+	for _, query := range []string{"", "?offset=0", "?offset=-1&size=1", "?offset=0&size=x"} {
+		if rec := get(segmentsPath + first.Name + query); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", query, rec.Code)
+		}
+	}
+
+	if err := testDb.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	after := getReplicationState(t, "")
+	if slices.ContainsFunc(after.Segments, func(seg segmentState) bool { return seg.Name == first.Name }) {
+		t.Fatalf("Expected compaction to remove %s, got %+v", first.Name, after.Segments)
+	}
+	if rec := get(segmentsPath + first.Name + "?offset=0&size=1"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a compacted segment, got %d", rec.Code)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Leader is down", http.StatusServiceUnavailable)
+	}))
+	defer leader.Close()
+
+	useTestDbWithOptions(t, t.TempDir(), datastore.Options{ReadOnly: true})
+	replica = startFollower(leader.URL)
+	defer func() {
+		if !replica.status().promoted {
+			replica.cancel()
+			<-replica.done
+		}
+		replica = nil
+	}()
+
+	if rec := serve(http.MethodPost, "/db/k", `{"value":"v"}`, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a write to a follower, got %d", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	handlePromote(rec, httptest.NewRequest(http.MethodPost, "/admin/promote", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for the promotion, got %d: %s", rec.Code, rec.Body)
+	}
+	var status struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil || status.Role != "leader" {
+		t.Errorf("Expected the leader role after promotion, got %q, %v", status.Role, err)
+	}
+
+	if rec := serve(http.MethodPost, "/db/k", `{"value":"v"}`, nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected a write after promotion to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodGet, "/db/k", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected to read the write back, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// shards holds the databases of a sharded data directory, in which case db
+// is nil. Keys are spread over them by datastore.ShardOf.
+var shards []*datastore.Db
+
+// dbFor returns the database holding key.
+func dbFor(key string) *datastore.Db {
+	if shards == nil {
+		return db
+	}
+	return shards[datastore.ShardOf(key, len(shards))]
+}
+
+// allDbs returns every database served.
+func allDbs() []*datastore.Db {
+	if shards == nil {
+		return []*datastore.Db{db}
+	}
+	return shards
+}
+
+// handleUnsharded wraps handlers that only work on a single database.
+func handleUnsharded(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if shards != nil {
+			http.Error(w, "Not supported with shards", http.StatusNotImplemented)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// shardIterator walks the keys of every shard in ascending order, like a
+// datastore.Iterator over all of them.
+type shardIterator struct {
+	its     []*datastore.Iterator
+	valid   []bool
+	current int
+	started bool
+}
+
+// newPrefixIterator iterates over the keys starting with prefix that sort
+// after cursor, or all of them for an empty cursor.
+func newPrefixIterator(prefix, cursor string) *shardIterator {
+	dbs := allDbs()
+	s := &shardIterator{
+		its:     make([]*datastore.Iterator, len(dbs)),
+		valid:   make([]bool, len(dbs)),
+		current: -1,
+	}
+	for i, db := range dbs {
+		if cursor == "" {
+			s.its[i] = db.NewPrefixIterator(prefix)
+		} else {
+			s.its[i] = db.NewPrefixIteratorAfter(prefix, cursor)
+		}
+	}
+	return s
+}
+
+func (s *shardIterator) Next() bool {
+	if !s.started {
+		s.started = true
+		for i, it := range s.its {
+			s.valid[i] = it.Next()
+		}
+	} else if s.current >= 0 {
+		s.valid[s.current] = s.its[s.current].Next()
+	}
+
+	s.current = -1
+	for i, it := range s.its {
+		if s.valid[i] && (s.current < 0 || it.Key() < s.its[s.current].Key()) {
+			s.current = i
+		}
+	}
+	return s.current >= 0
+}
+
+func (s *shardIterator) Key() string {
+	return s.its[s.current].Key()
+}
+
+func (s *shardIterator) Value() any {
+	return s.its[s.current].Value()
+}
+
+func (s *shardIterator) Err() error {
+	var errs []error
+	for _, it := range s.its {
+		errs = append(errs, it.Err())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *shardIterator) Close() {
+	for _, it := range s.its {
+		it.Close()
+	}
+}
+
+// batchShard returns the database all keys of a batch belong to. A batch
+// is only atomic within one shard.
+func batchShard(keys []string) (*datastore.Db, error) {
+	if len(keys) == 0 {
+		return allDbs()[0], nil
+	}
+	first := dbFor(keys[0])
+	for _, key := range keys[1:] {
+		if dbFor(key) != first {
+			return nil, fmt.Errorf("keys %q and %q belong to different shards", keys[0], key)
+		}
+	}
+	return first, nil
+}
+
+// watchShards streams the changes of every shard until one of the
+// subscriptions ends or the client goes away. Sequence numbers are per
+// shard, so the events carry no id to resume from.
+func watchShards(w http.ResponseWriter, r *http.Request, prefix string, flusher http.Flusher) {
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.Context().Done())},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(keepAlive.C)},
+	}
+	for _, db := range shards {
+		sub := db.Subscribe(prefix)
+		defer sub.Close()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sub.Changes())})
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		chosen, value, ok := reflect.Select(cases)
+		switch {
+		case chosen == 0:
+			return
+		case chosen == 1:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case !ok:
+			log.Printf("Ending watch of %q: shard %d subscription ended", prefix, chosen-2)
+			return
+		default:
+			if err := writeChange(w, value.Interface().(datastore.Change), false); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// useTestShards serves n fresh shards for the duration of the test.
+func useTestShards(t *testing.T, n int, opts datastore.Options) []*datastore.Db {
+	t.Helper()
+	testShards, err := datastore.OpenShards(t.TempDir(), n, opts)
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	db, shards = nil, testShards
+	t.Cleanup(func() {
+		for _, shard := range testShards {
+			shard.Close()
+		}
+		shards = nil
+	})
+	return testShards
+}
+
+// shardKeys returns count keys that belong to shard i of n.
+func shardKeys(i, n, count int) []string {
+	var keys []string
+	for k := 0; len(keys) < count; k++ {
+		if key := fmt.Sprintf("key-%d", k); datastore.ShardOf(key, n) == i {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestShardedList(t *testing.T) {
+	testShards := useTestShards(t, 3, datastore.Options{})
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("p/%02d", i)
+		keys = append(keys, key)
+		if rec := serve(http.MethodPost, "/db/"+key, `{"value":"v"}`, nil); rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for the write, got %d", rec.Code)
+		}
+	}
+	if err := testShards[0].Put("q/1", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	for i, shard := range testShards {
+		if len(shard.Keys("p/")) == 0 {
+			t.Fatalf("Expected shard %d to hold some of the keys", i)
+		}
+	}
+
+	var listed []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("Expected paging to end, got keys %v", listed)
+		}
+		rec := serve(http.MethodGet, "/db/?prefix=p/&limit=3&cursor="+url.QueryEscape(cursor), "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var page struct {
+			Items []struct {
+				Key string `json:"key"`
+			} `json:"items"`
+			Cursor string `json:"cursor"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("Failed to decode page: %v", err)
+		}
+		for _, item := range page.Items {
+			listed = append(listed, item.Key)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+	}
+	if !reflect.DeepEqual(listed, keys) {
+		t.Errorf("Expected the pages to merge the shards into %v, got %v", keys, listed)
+	}
+}
+
+func TestShardedBatch(t *testing.T) {
+	testShards := useTestShards(t, 3, datastore.Options{})
+	same := shardKeys(1, 3, 2)
+	other := shardKeys(2, 3, 1)[0]
+
+	body := fmt.Sprintf(`{"ops":[{"op":"put","key":%q,"value":"v"},{"op":"put","key":%q,"value":"v"}]}`, same[0], same[1])
+	if rec := serve(http.MethodPost, "/db/_batch", body, nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected a batch within one shard to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	if keys := testShards[1].Keys(""); !reflect.DeepEqual(keys, same) {
+		t.Errorf("Expected the batch in shard 1, got %v", keys)
+	}
+
+	body = fmt.Sprintf(`{"ops":[{"op":"put","key":%q,"value":"v"},{"op":"delete","key":%q}]}`, other, same[0])
+	if rec := serve(http.MethodPost, "/db/_batch", body, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a batch spanning shards, got %d", rec.Code)
+	}
+	if _, err := testShards[2].Get(other); err != datastore.ErrNotFound {
+		t.Errorf("Expected nothing of the rejected batch to be written, got %v", err)
+	}
+}
+
+func TestShardedUnsupported(t *testing.T) {
+	useTestShards(t, 2, datastore.Options{})
+	for _, handler := range []http.HandlerFunc{
+		handleUnsharded(handleBackup),
+		handleUnsharded(handleReplicationState),
+		handleUnsharded(handlePromote),
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/admin/", nil))
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("Expected 501 with shards, got %d", rec.Code)
+		}
+	}
+}
+
+func TestShardedAdmin(t *testing.T) {
+	const n = 3
+	testShards := useTestShards(t, n, datastore.Options{})
+	for i, shard := range testShards {
+		keys := shardKeys(i, n, 3)
+		for _, key := range append(keys, keys...) {
+			if err := shard.Put(key, "value"); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+	}
+
+	compact := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleCompact(rec, httptest.NewRequest(http.MethodPost, "/admin/compact", nil))
+		return rec
+	}
+	health := func() string {
+		rec := httptest.NewRecorder()
+		handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		var response struct {
+			Status string `json:"status"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode health: %v", err)
+		}
+		return response.Status
+	}
+
+	rec := compact()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var statuses []compactionStatus
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatalf("Failed to decode compaction status: %v", err)
+	}
+	if len(statuses) != n {
+		t.Fatalf("Expected a status per shard, got %d", len(statuses))
+	}
+	for i, status := range statuses {
+		if status.Compactions != 1 || status.CompactionError != "" {
+			t.Errorf("Expected shard %d to be compacted once, got %+v", i, status)
+		}
+	}
+	if status := health(); status != "ok" {
+		t.Errorf("Expected ok health, got %q", status)
+	}
+
+	// Taking the name the merge output of the last shard needs makes its
+	// next run fail.
+	last := testShards[n-1]
+	for _, key := range shardKeys(n-1, n, 1) {
+		if err := last.Put(key, "other"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	segments := last.Stats().Segments
+	current := segments[len(segments)-1].Path
+	ts, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(current), "segment-"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker := filepath.Join(filepath.Dir(current), "segment-"+strconv.FormatInt(ts+1, 10))
+	if err := os.Mkdir(blocker, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if rec := compact(); rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the failed compaction to be reported, got %d", rec.Code)
+	}
+	if status := health(); status != "degraded" {
+		t.Errorf("Expected degraded health when one shard fails to compact, got %q", status)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// decodeValue turns the JSON value of a request into the value to store,
+// as the type named typ or, if typ is empty, the type the JSON suggests.
+func decodeValue(raw json.RawMessage, typ string) (any, error) {
+	var dt datastore.DataType
+	if typ != "" {
+		var err error
+		if dt, err = datastore.ParseDataType(typ); err != nil {
+			return nil, err
+		}
+	}
+	return datastore.ValueFromJSON(raw, dt)
+}
+
+// knownType reports whether typ names a type values can be stored as.
+func knownType(typ string) bool {
+	_, err := datastore.ParseDataType(typ)
+	return err == nil
+}
+
+// valueType names the type of a value read from the datastore.
+func valueType(value any) string {
+	return datastore.TypeOf(value).String()
+}
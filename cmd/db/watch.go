@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	watchKey = "_watch"
+	// watchKeepAlive is how often an idle watch stream sends a comment so
+	// that proxies do not time it out.
+	watchKeepAlive = 15 * time.Second
+)
+
+// handleWatch streams the changes of keys starting with the prefix query
+// parameter as Server-Sent Events. Every event carries the sequence number
+// of its write as id. A client resumes after a given sequence number with
+// the Last-Event-ID header, which EventSource sends on reconnect, or with
+// the since query parameter; the changes it missed are read from the log.
+// When compaction has already rewritten them the answer is 410 Gone and the
+// client has to reload the keys instead.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	var after uint64
+	if since != "" {
+		var err error
+		after, err = strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if shards != nil {
+		if since != "" {
+			http.Error(w, "Resuming is not supported with shards", http.StatusNotImplemented)
+			return
+		}
+		watchShards(w, r, prefix, flusher)
+		return
+	}
+	sub := db.Subscribe(prefix)
+	defer sub.Close()
+
+	replay := since != "" && after < sub.StartSeq
+	if replay {
+		if err := db.CheckChanges(after); errors.Is(err, datastore.ErrChangesCompacted) {
+			http.Error(w, "Changes since "+since+" are no longer available", http.StatusGone)
+			return
+		} else if err != nil {
+			log.Printf("Failed to replay changes: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	last := sub.StartSeq
+	if replay {
+		err := db.ReadChanges(prefix, after, sub.StartSeq, func(change datastore.Change) error {
+			return writeChange(w, change, true)
+		})
+		if err != nil {
+			// Compacted just now, if at all: the client reconnects and is
+			// told so.
+			log.Printf("Failed to replay changes: %v", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case change, ok := <-sub.Changes():
+			if !ok {
+				// The client reconnects and catches up from the log.
+				if err := sub.Err(); err != nil {
+					log.Printf("Ending watch of %q: %v", prefix, err)
+				}
+				return
+			}
+			if change.Seq <= last {
+				continue
+			}
+			last = change.Seq
+			if err := writeChange(w, change, true); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeChange writes change as a put or delete event, with its sequence
+// number as id if withID is set.
+func writeChange(w http.ResponseWriter, change datastore.Change, withID bool) error {
+	event := struct {
+		Key   string `json:"key"`
+		Type  string `json:"type,omitempty"`
+		Value any    `json:"value,omitempty"`
+		Seq   uint64 `json:"seq"`
+	}{
+		Key: change.Key,
+		Seq: change.Seq,
+	}
+	name := "delete"
+	if !change.Deleted {
+		name = "put"
+		event.Type = valueType(change.Value)
+		event.Value = change.Value
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if withID {
+		if _, err := fmt.Fprintf(w, "id: %d\n", change.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchReplaysBeforeLiveChanges(t *testing.T) {
+	testDb := useTestDb(t)
+	for _, key := range []string{"a/1", "b/1", "a/2", "a/3"} {
+		if err := testDb.Put(key, "v"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	entry, err := testDb.GetEntry("a/1")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	server := httptest.NewServer(http.HandlerFunc(dbHandler))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/db/_watch?prefix=a/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(entry.Seq, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// The subscription is in place once the headers are sent.
+	if err := testDb.Put("b/2", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := testDb.Put("a/4", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(keys) < 3 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("Failed to decode event %q: %v", data, err)
+		}
+		keys = append(keys, event.Key)
+	}
+	if expected := []string{"a/2", "a/3", "a/4"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the replayed changes then the live one, %v, got %v", expected, keys)
+	}
+	if strings.Contains(logs.String(), "superfluous") {
+		t.Errorf("Expected the headers to be written once, got logs:\n%s", logs)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// segmentArgs returns the segment files of dir, or the files named on the
+// command line if dir is empty.
+func segmentArgs(name, dir string, args []string) ([]string, error) {
+	if dir == "" {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s: -dir or segment files are required", name)
+		}
+		return args, nil
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%s: -dir and segment files are mutually exclusive", name)
+	}
+	return datastore.SegmentFiles(dir)
+}
+
+func runDump(args []string) error {
+	fs := newFlagSet("dump", "segment...")
+	dir := fs.String("dir", "", "dump every segment of this data directory")
+	values := fs.Bool("values", false, "print record values")
+	fs.Parse(args)
+
+	paths, err := segmentArgs("dump", *dir, fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := dumpSegment(os.Stdout, path, *values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpSegment prints one line per record of the segment at path.
+func dumpSegment(out io.Writer, path string, values bool) error {
+	fmt.Fprintf(out, "%s:\n", path)
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	header := "OFFSET\tSIZE\tSEQ\tTYPE\tFLAGS\tKEY"
+	if values {
+		header += "\tVALUE"
+	}
+	fmt.Fprintln(tw, header)
+
+	err := datastore.WalkSegment(path, func(info datastore.RecordInfo) error {
+		if info.Err != nil {
+			fmt.Fprintf(tw, "%d\t%d\t\tdamaged\t\t%v\n", info.Offset, info.Size, info.Err)
+			return nil
+		}
+		line := fmt.Sprintf("%d\t%d\t%d\t%s\t%s\t%s",
+			info.Offset, info.Size, info.Seq, info.Type, recordFlags(info), info.Key)
+		if values {
+			line += "\t" + formatValue(info.Value)
+		}
+		fmt.Fprintln(tw, line)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func recordFlags(info datastore.RecordInfo) string {
+	var flags []string
+	if info.Batch {
+		flags = append(flags, "batch")
+	}
+	if info.Compressed {
+		flags = append(flags, "compressed")
+	}
+	if !info.ExpiresAt.IsZero() {
+		flags = append(flags, "expires="+info.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	if len(flags) == 0 {
+		return "-"
+	}
+	return strings.Join(flags, ",")
+}
+
+// formatValue prints a value the way export would, on one line.
+func formatValue(value any) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func runVerify(args []string) error {
+	fs := newFlagSet("verify", "segment...")
+	dir := fs.String("dir", "", "verify every segment of this data directory")
+	fs.Parse(args)
+
+	paths, err := segmentArgs("verify", *dir, fs.Args())
+	if err != nil {
+		return err
+	}
+	bad, err := verifySegments(os.Stdout, paths)
+	if err != nil {
+		return err
+	}
+	if bad > 0 {
+		return fmt.Errorf("verify: %d damaged records", bad)
+	}
+	log.Printf("verified %d segments", len(paths))
+	return nil
+}
+
+// verifySegments reports every damaged record of the segments at paths and
+// returns how many there were.
+func verifySegments(out io.Writer, paths []string) (int, error) {
+	bad := 0
+	for _, path := range paths {
+		records := 0
+		err := datastore.WalkSegment(path, func(info datastore.RecordInfo) error {
+			if info.Err != nil {
+				bad++
+				fmt.Fprintf(out, "%s: offset %d: %v\n", path, info.Offset, info.Err)
+			} else {
+				records++
+			}
+			return nil
+		})
+		if err != nil {
+			return bad, err
+		}
+		fmt.Fprintf(out, "%s: %d records\n", path, records)
+	}
+	return bad, nil
+}
+
+func runRepair(args []string) error {
+	fs := newFlagSet("repair", "segment...")
+	dir := fs.String("dir", "", "repair every segment of this data directory")
+	fs.Parse(args)
+
+	paths, err := segmentArgs("repair", *dir, fs.Args())
+	if err != nil {
+		return err
+	}
+	// A running service would go on appending to the segment it had open.
+	locked := make(map[string]bool)
+	for _, path := range paths {
+		segDir := filepath.Dir(path)
+		if locked[segDir] {
+			continue
+		}
+		lock, err := datastore.LockDir(segDir)
+		if err != nil {
+			return fmt.Errorf("repair: %s: %w", segDir, err)
+		}
+		defer lock.Close()
+		locked[segDir] = true
+	}
+
+	repaired := 0
+	for _, path := range paths {
+		bad, err := datastore.RepairSegment(path)
+		if err != nil {
+			return fmt.Errorf("repair: %s: %w", path, err)
+		}
+		for _, recErr := range bad {
+			log.Printf("dropped %v", recErr)
+		}
+		if len(bad) > 0 {
+			repaired++
+			log.Printf("repaired %s, original kept as %s.damaged", path, path)
+		}
+	}
+	log.Printf("repaired %d of %d segments", repaired, len(paths))
+	return nil
+}
+
+func runStats(args []string) error {
+	fs := newFlagSet("stats", "")
+	dir := fs.String("dir", "", "data directory")
+	fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("stats: -dir is required")
+	}
+
+	db, err := datastore.OpenWithOptions(*dir, datastore.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return printStats(os.Stdout, db.Stats())
+}
+
+// printStats prints a line per segment and the totals.
+func printStats(out io.Writer, stats datastore.Stats) error {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SEGMENT\tSIZE\tKEYS\tLIVE\tDEAD\tDEAD%\t")
+	for _, s := range stats.Segments {
+		printStatsLine(tw, filepath.Base(s.Path), s)
+	}
+	printStatsLine(tw, "total", datastore.SegmentStats{
+		Size:      stats.Size,
+		LiveKeys:  stats.Keys,
+		LiveBytes: stats.LiveBytes,
+	})
+	return tw.Flush()
+}
+
+func printStatsLine(w io.Writer, name string, s datastore.SegmentStats) {
+	dead := 0.0
+	if s.Size > 0 {
+		dead = 100 * float64(s.DeadBytes()) / float64(s.Size)
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.1f\t\n", name, s.Size, s.LiveKeys, s.LiveBytes, s.DeadBytes(), dead)
+}
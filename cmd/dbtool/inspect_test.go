@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestInspectSegments(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.PutWithTTL("k2", "v2", time.Hour); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Delete("k1"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := printStats(out, db.Stats()); err != nil {
+		t.Fatalf("Failed to print stats: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 {
+		t.Errorf("Expected a header, a segment and a total line, got:\n%s", out)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("Expected one segment, got %v, %v", paths, err)
+	}
+
+	out.Reset()
+	if err := dumpSegment(out, paths[0], true); err != nil {
+		t.Fatalf("Failed to dump: %v", err)
+	}
+	for _, want := range []string{`k1`, `"v1"`, `tombstone`, `expires=`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the dump:\n%s", want, out)
+		}
+	}
+
+	out.Reset()
+	if bad, err := verifySegments(out, paths); err != nil || bad != 0 {
+		t.Errorf("Expected no damaged records, got %d, %v", bad, err)
+	}
+
+	// Damage the last byte of the tombstone.
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(paths[0], data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if bad, err := verifySegments(out, paths); err != nil || bad != 1 {
+		t.Errorf("Expected one damaged record, got %d, %v:\n%s", bad, err, out)
+	}
+}
+
+func TestRepairLocked(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := runRepair([]string{"-dir", dir}); !errors.Is(err, datastore.ErrLocked) {
+		t.Errorf("Expected repair of an open data directory to fail with ErrLocked, got %v", err)
+	}
+}
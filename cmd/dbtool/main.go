@@ -0,0 +1,85 @@
+// Command dbtool moves data in and out of datastore data directories and
+// inspects and repairs their segment files offline.
+//
+// Usage:
+//
+//	dbtool <command> [flags] [file]
+//
+// Run dbtool <command> -h for the flags of a command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"restore", "restore a backup archive into a new data directory", runRestore},
+	{"import", "import key/value pairs from JSON Lines or CSV", runImport},
+	{"export", "export the live key set as JSON Lines", runExport},
+	{"dump", "print the records of segment files", runDump},
+	{"verify", "check segment files for damaged records", runVerify},
+	{"repair", "drop damaged records from segment files", runRepair},
+	{"stats", "show live and dead bytes per segment", runStats},
+	{"reshard", "move keys of a data directory to a new shard count", runReshard},
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dbtool: ")
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbtool <command> [flags] [file]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// newFlagSet returns the flag set of a command taking an optional file
+// argument, or none if file is empty.
+func newFlagSet(name, file string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		if file == "" {
+			fmt.Fprintf(fs.Output(), "usage: dbtool %s [flags]\n", name)
+		} else {
+			fmt.Fprintf(fs.Output(), "usage: dbtool %s [flags] [%s]\n", name, file)
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// openInput opens the file named by the only argument, or stdin if there is
+// none or it is "-".
+func openInput(args []string) (*os.File, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(args[0])
+}
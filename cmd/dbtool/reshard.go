@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func runReshard(args []string) error {
+	fs := newFlagSet("reshard", "")
+	dir := fs.String("dir", "", "data directory, sharded or not; the service must be stopped")
+	shards := fs.Int("shards", 0, "new number of shards")
+	fs.Parse(args)
+	if *dir == "" || *shards <= 0 {
+		return fmt.Errorf("reshard: -dir and a positive -shards are required")
+	}
+
+	report, err := datastore.Reshard(*dir, *shards)
+	if err != nil {
+		return fmt.Errorf("reshard: %w", err)
+	}
+	log.Printf("resharded %s from %d to %d shards: %d keys moved, %d stale copies removed",
+		*dir, report.From, report.To, report.Moved, report.Removed)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestReshard(t *testing.T) {
+	dir := t.TempDir()
+	shards, err := datastore.OpenShards(dir, 2, datastore.Options{})
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := shards[datastore.ShardOf(key, 2)].Put(key, "v"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	for _, db := range shards {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+	}
+
+	if err := runReshard([]string{"-dir", dir, "-shards", "3"}); err != nil {
+		t.Fatalf("Failed to reshard: %v", err)
+	}
+	if _, err := datastore.OpenShards(dir, 2, datastore.Options{}); err == nil {
+		t.Error("Expected the old shard count to be rejected")
+	}
+	shards, err = datastore.OpenShards(dir, 3, datastore.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open resharded shards: %v", err)
+	}
+	defer func() {
+		for _, db := range shards {
+			db.Close()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if _, err := shards[datastore.ShardOf(key, 3)].Get(key); err != nil {
+			t.Errorf("Expected %s in shard %d, got %v", key, datastore.ShardOf(key, 3), err)
+		}
+	}
+
+	if err := runReshard([]string{"-dir", t.TempDir(), "-shards", "3"}); err == nil {
+		t.Error("Expected an unsharded directory to be rejected")
+	}
+}
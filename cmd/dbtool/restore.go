@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func runRestore(args []string) error {
+	fs := newFlagSet("restore", "archive")
+	dir := fs.String("dir", "", "data directory to create")
+	fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("restore: -dir is required")
+	}
+
+	in, err := openInput(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := datastore.Restore(in, *dir); err != nil {
+		return err
+	}
+
+	// Make sure what we restored is a data directory the service can open.
+	db, err := datastore.OpenWithOptions(*dir, datastore.Options{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("restore: restored data does not open: %w", err)
+	}
+	defer db.Close()
+
+	log.Printf("restored %d keys into %s", len(db.Keys("")), *dir)
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// jsonLine is one exported pair, shaped like a GET /db/{key} response plus
+// the expiry of keys that have one.
+type jsonLine struct {
+	Key       string          `json:"key"`
+	Type      string          `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+func runImport(args []string) error {
+	fs := newFlagSet("import", "file")
+	dir := fs.String("dir", "", "data directory to import into")
+	format := fs.String("format", "jsonl", "input format: jsonl or csv")
+	typ := fs.String("type", "", "type of CSV values without a type column, string by default")
+	header := fs.Bool("header", false, "skip the first CSV row")
+	batchSize := fs.Int("batch", 1000, "number of pairs written per atomic batch")
+	fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("import: -dir is required")
+	}
+
+	in, err := openInput(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	db, err := datastore.Open(*dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := &batchWriter{db: db, size: *batchSize}
+	switch *format {
+	case "jsonl":
+		err = importJSONL(w, in)
+	case "csv":
+		err = importCSV(w, in, *typ, *header)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	log.Printf("imported %d pairs into %s, skipped %d already expired", w.written, *dir, w.expired)
+	return nil
+}
+
+// batchWriter puts pairs through datastore batches so that a large import
+// does not pay one sync per key.
+type batchWriter struct {
+	db      *datastore.Db
+	size    int
+	batch   datastore.Batch
+	written int
+	// expired counts pairs skipped because they expired before import.
+	expired int
+}
+
+// put adds a pair expiring at expiresAt, or never for the zero time.
+func (w *batchWriter) put(key string, value any, expiresAt time.Time) error {
+	if !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		w.expired++
+		return nil
+	}
+	if err := w.batch.PutValueUntil(key, value, expiresAt); err != nil {
+		return err
+	}
+	if w.batch.Len() >= w.size {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *batchWriter) flush() error {
+	if err := w.db.Write(&w.batch); err != nil {
+		return err
+	}
+	w.written += w.batch.Len()
+	w.batch = datastore.Batch{}
+	return nil
+}
+
+// importJSONL reads lines like the ones exportJSONL writes. Without a type
+// the value is typed the way POST /db/{key} types it.
+func importJSONL(w *batchWriter, in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line jsonLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if line.Key == "" {
+			return fmt.Errorf("line %d: key is required", n)
+		}
+
+		var dt datastore.DataType
+		if line.Type != "" {
+			var err error
+			if dt, err = datastore.ParseDataType(line.Type); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+		value, err := datastore.ValueFromJSON(line.Value, dt)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		var expiresAt time.Time
+		if line.ExpiresAt != nil {
+			expiresAt = *line.ExpiresAt
+		}
+		if err := w.put(line.Key, value, expiresAt); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// importCSV reads rows of key, value and an optional type column. Values
+// are plain text: numbers and booleans as Go parses them, bytes base64
+// encoded and JSON documents verbatim.
+func importCSV(w *batchWriter, in io.Reader, defaultType string, header bool) error {
+	if defaultType == "" {
+		defaultType = datastore.DataTypeString.String()
+	}
+
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	for n := 1; ; n++ {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header && n == 1 {
+			continue
+		}
+		if len(row) < 2 || len(row) > 3 {
+			return fmt.Errorf("row %d: expected key,value[,type], got %d columns", n, len(row))
+		}
+
+		typ := defaultType
+		if len(row) == 3 && row[2] != "" {
+			typ = row[2]
+		}
+		value, err := textValue(row[1], typ)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", n, err)
+		}
+		if err := w.put(row[0], value, time.Time{}); err != nil {
+			return fmt.Errorf("row %d: %w", n, err)
+		}
+	}
+}
+
+func textValue(text, typ string) (any, error) {
+	dt, err := datastore.ParseDataType(typ)
+	if err != nil {
+		return nil, err
+	}
+	switch dt {
+	case datastore.DataTypeInt64:
+		return strconv.ParseInt(text, 10, 64)
+	case datastore.DataTypeFloat64:
+		return strconv.ParseFloat(text, 64)
+	case datastore.DataTypeBool:
+		return strconv.ParseBool(text)
+	case datastore.DataTypeBytes:
+		return base64.StdEncoding.DecodeString(text)
+	case datastore.DataTypeJSON:
+		if !json.Valid([]byte(text)) {
+			return nil, fmt.Errorf("not a JSON document: %q", text)
+		}
+		return json.RawMessage(text), nil
+	default:
+		return text, nil
+	}
+}
+
+func runExport(args []string) error {
+	fs := newFlagSet("export", "file")
+	dir := fs.String("dir", "", "data directory to export")
+	prefix := fs.String("prefix", "", "export only keys starting with this prefix")
+	fs.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("export: -dir is required")
+	}
+
+	db, err := datastore.OpenWithOptions(*dir, datastore.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if args := fs.Args(); len(args) > 0 && args[0] != "-" {
+		if out, err = os.Create(args[0]); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(out)
+	n, err := exportJSONL(db, bw, *prefix)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	log.Printf("exported %d pairs from %s", n, *dir)
+	return nil
+}
+
+// exportJSONL writes every live pair with a key starting with prefix as a
+// JSON line, in key order, and returns how many it wrote.
+func exportJSONL(db *datastore.Db, out io.Writer, prefix string) (int, error) {
+	it := db.NewPrefixIterator(prefix)
+	defer it.Close()
+
+	enc := json.NewEncoder(out)
+	n := 0
+	for it.Next() {
+		raw, err := json.Marshal(it.Value())
+		if err != nil {
+			return n, err
+		}
+		line := jsonLine{
+			Key:   it.Key(),
+			Type:  datastore.TypeOf(it.Value()).String(),
+			Value: raw,
+		}
+		entry, err := db.GetEntry(it.Key())
+		if errors.Is(err, datastore.ErrNotFound) {
+			// Expired since the iterator was made.
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if !entry.ExpiresAt.IsZero() {
+			line.ExpiresAt = &entry.ExpiresAt
+		}
+		if err := enc.Encode(line); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, it.Err()
+}
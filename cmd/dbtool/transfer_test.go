@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func openTestDb(t *testing.T) *datastore.Db {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestImportExportRoundTrip(t *testing.T) {
+	db := openTestDb(t)
+	w := &batchWriter{db: db, size: 2}
+
+	jsonl := `{"key":"s","value":"text"}
+{"key":"i","value":42}
+
+{"key":"f","value":3,"type":"float64"}
+{"key":"j","value":{"a":[1,2]}}
+`
+	if err := importJSONL(w, strings.NewReader(jsonl)); err != nil {
+		t.Fatalf("Failed to import JSON Lines: %v", err)
+	}
+	csvData := "key,value,type\nb,aGk=,bytes\nt,true,bool\nplain,\"a,b\"\n"
+	if err := importCSV(w, strings.NewReader(csvData), "", true); err != nil {
+		t.Fatalf("Failed to import CSV: %v", err)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if w.written != 7 {
+		t.Errorf("Expected 7 pairs written, got %d", w.written)
+	}
+
+	if v, err := db.GetFloat64("f"); err != nil || v != 3 {
+		t.Errorf("Expected float64 3, got %v, %v", v, err)
+	}
+	if v, err := db.GetBytes("b"); err != nil || string(v) != "hi" {
+		t.Errorf("Expected bytes hi, got %q, %v", v, err)
+	}
+	if v, err := db.Get("plain"); err != nil || v != "a,b" {
+		t.Errorf("Expected string a,b, got %q, %v", v, err)
+	}
+
+	exported := &bytes.Buffer{}
+	n, err := exportJSONL(db, exported, "")
+	if err != nil || n != 7 {
+		t.Fatalf("Expected 7 exported pairs, got %d, %v", n, err)
+	}
+
+	// Re-importing the export yields the same data, types included.
+	other := openTestDb(t)
+	ow := &batchWriter{db: other, size: 100}
+	if err := importJSONL(ow, bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatalf("Failed to re-import export: %v", err)
+	}
+	if err := ow.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	again := &bytes.Buffer{}
+	if _, err := exportJSONL(other, again, ""); err != nil {
+		t.Fatalf("Failed to export again: %v", err)
+	}
+	if exported.String() != again.String() {
+		t.Errorf("Round trip changed the data:\n%s\nvs\n%s", exported, again)
+	}
+
+	var first jsonLine
+	if err := json.Unmarshal(bytes.SplitN(exported.Bytes(), []byte("\n"), 2)[0], &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Key != "b" || first.Type != "bytes" {
+		t.Errorf("Expected exports in key order with types, got %+v", first)
+	}
+}
+
+func TestImportRejectsBadInput(t *testing.T) {
+	db := openTestDb(t)
+	w := &batchWriter{db: db, size: 10}
+
+	if err := importJSONL(w, strings.NewReader(`{"value":"no key"}`)); err == nil {
+		t.Errorf("Expected a line without a key to fail")
+	}
+	if err := importCSV(w, strings.NewReader("k,notanumber,int64\n"), "", false); err == nil {
+		t.Errorf("Expected an invalid int64 to fail")
+	}
+}
+
+func TestExportKeepsExpiry(t *testing.T) {
+	db := openTestDb(t)
+	if err := db.PutWithTTL("ttl", "expiring", time.Hour); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("plain", "forever"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	want, _ := db.GetEntry("ttl")
+
+	exported := &bytes.Buffer{}
+	if _, err := exportJSONL(db, exported, ""); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	// An entry that expired between export and import.
+	exported.WriteString(`{"key":"stale","value":"old","expires_at":"2000-01-01T00:00:00Z"}` + "\n")
+
+	other := openTestDb(t)
+	w := &batchWriter{db: other, size: 100}
+	if err := importJSONL(w, exported); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if w.written != 2 || w.expired != 1 {
+		t.Errorf("Expected 2 pairs written and 1 expired, got %d and %d", w.written, w.expired)
+	}
+
+	if entry, err := other.GetEntry("ttl"); err != nil || !entry.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Errorf("Expected ttl to expire at %v, got %v, %v", want.ExpiresAt, entry.ExpiresAt, err)
+	}
+	if entry, err := other.GetEntry("plain"); err != nil || !entry.ExpiresAt.IsZero() {
+		t.Errorf("Expected plain not to expire, got %v, %v", entry.ExpiresAt, err)
+	}
+	if _, err := other.Get("stale"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Expected the expired pair to be skipped, got %v", err)
+	}
+}
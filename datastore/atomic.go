@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// IncrementInt64 adds delta to the int64 stored under key and returns the
+// result. A missing key counts as zero. The read and the write happen under
+// the write lock, so concurrent increments never get lost. An expiry set on
+// the key is kept.
+func (db *Db) IncrementInt64(key string, delta int64) (int64, error) {
+	var result int64
+	err := db.commit(func() error {
+		current := &record{}
+		err := db.getLocked(current, key)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			current = NewInt64Record(key, 0)
+		case err != nil:
+			return err
+		case current.dataType != DataTypeInt64:
+			return fmt.Errorf("%w: expected %v, got %v", ErrTypeMismatch, DataTypeInt64, current.dataType)
+		}
+
+		rec := NewInt64Record(key, current.value.(int64)+delta)
+		rec.expiresAt = current.expiresAt
+		pos, err := db.writeLocked(*rec)
+		if err != nil {
+			return err
+		}
+		db.setIndexLocked(key, pos)
+		result = rec.value.(int64)
+
+		return nil
+	})
+	return result, err
+}
+
+// CompareAndSwap stores new under key only if the current value equals old,
+// both in type and value, and reports whether it did. A nil old matches a
+// missing key only. Values take the types PutValue accepts.
+func (db *Db) CompareAndSwap(key string, old, new any) (bool, error) {
+	rec, err := newValueRecord(key, new)
+	if err != nil {
+		return false, err
+	}
+
+	swapped := false
+	err = db.commit(func() error {
+		current := &record{}
+		err := db.getLocked(current, key)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			if old != nil {
+				return nil
+			}
+		case err != nil:
+			return err
+		case !valuesEqual(current.value, old):
+			return nil
+		}
+
+		pos, err := db.writeLocked(*rec)
+		if err != nil {
+			return err
+		}
+		db.setIndexLocked(key, pos)
+		swapped = true
+
+		return nil
+	})
+	return swapped, err
+}
+
+func valuesEqual(a, b any) bool {
+	switch a := a.(type) {
+	case []byte:
+		b, ok := b.([]byte)
+		return ok && bytes.Equal(a, b)
+	case json.RawMessage:
+		b, ok := b.(json.RawMessage)
+		return ok && bytes.Equal(a, b)
+	case string, int64, float64, bool:
+		return a == b
+	default:
+		return false
+	}
+}
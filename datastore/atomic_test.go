@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestIncrementInt64(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{Sync: SyncNone})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	const workers, increments = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if _, err := db.IncrementInt64("counter", 1); err != nil {
+					t.Errorf("Failed to increment: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := db.GetInt64("counter"); err != nil || value != workers*increments {
+		t.Errorf("Expected %d, got %d, %v", workers*increments, value, err)
+	}
+	if value, err := db.IncrementInt64("counter", -800); err != nil || value != 0 {
+		t.Errorf("Expected 0 after decrement, got %d, %v", value, err)
+	}
+
+	if err := db.Put("text", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if _, err := db.IncrementInt64("text", 1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected ErrTypeMismatch incrementing a string, got %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if swapped, err := db.CompareAndSwap("k", nil, "first"); err != nil || !swapped {
+		t.Fatalf("Expected to create a missing key, got %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap("k", nil, "again"); err != nil || swapped {
+		t.Errorf("Expected nil old not to match an existing key, got %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap("k", "stale", "second"); err != nil || swapped {
+		t.Errorf("Expected a stale old value not to match, got %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap("k", "first", []byte("second")); err != nil || !swapped {
+		t.Errorf("Expected the current value to match, got %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap("k", "second", "third"); err != nil || swapped {
+		t.Errorf("Expected a value of another type not to match, got %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap("k", []byte("second"), int64(3)); err != nil || !swapped {
+		t.Errorf("Expected bytes to compare by content, got %v, %v", swapped, err)
+	}
+
+	if value, err := db.GetInt64("k"); err != nil || value != 3 {
+		t.Errorf("Expected 3, got %d, %v", value, err)
+	}
+}
@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshotFile is a data file as it was when a snapshot was taken: only its
+// first size bytes belong to the snapshot.
+type snapshotFile struct {
+	path string
+	size int64
+	// sealed files never change again, so they may be hard-linked.
+	sealed bool
+}
+
+// snapshotFiles lists the files making up the database right now and pins
+// them so that compaction does not remove them while they are copied. The
+// caller must call unpinSegments once done. The current segment is cut at
+// the end of the last complete write.
+func (db *Db) snapshotFiles() ([]snapshotFile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var files []snapshotFile
+	for _, seg := range db.segments {
+		info, err := os.Stat(seg.name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, snapshotFile{seg.name, info.Size(), true})
+
+		hint := hintPath(seg.name)
+		if info, err := os.Stat(hint); err == nil {
+			files = append(files, snapshotFile{hint, info.Size(), true})
+		}
+	}
+	if db.currentSegment != nil {
+		files = append(files, snapshotFile{db.currentSegment.Name(), db.currentOffset, false})
+	}
+	db.pinSegmentsLocked()
+
+	return files, nil
+}
+
+// Checkpoint writes a consistent copy of the database into dir, which must
+// not exist yet. Writes may go on meanwhile; they are not part of the copy.
+// Sealed segments are hard-linked when dir is on the same file system and
+// copied otherwise. Open the copy with Open like any data directory.
+func (db *Db) Checkpoint(dir string) error {
+	files, err := db.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	defer db.unpinSegments()
+
+	if err := os.Mkdir(dir, db.opts.DirMode); err != nil {
+		return err
+	}
+	for _, file := range files {
+		target := filepath.Join(dir, filepath.Base(file.path))
+		if file.sealed && os.Link(file.path, target) == nil {
+			continue
+		}
+		if err := copyFilePrefix(file.path, target, file.size, db.opts.FileMode); err != nil {
+			return fmt.Errorf("checkpoint %s: %w", file.path, err)
+		}
+	}
+	return syncDir(dir)
+}
+
+// Backup writes a consistent copy of the database to w as a tar archive of
+// a data directory. Writes may go on meanwhile; they are not part of the
+// copy.
+func (db *Db) Backup(w io.Writer) error {
+	files, err := db.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	defer db.unpinSegments()
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    filepath.Base(file.path),
+			Mode:    int64(db.opts.FileMode),
+			Size:    file.size,
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyPrefix(tw, file.path, file.size); err != nil {
+			return fmt.Errorf("backup %s: %w", file.path, err)
+		}
+	}
+	return tw.Close()
+}
+
+// Restore extracts an archive written by Backup into dir, which must not
+// exist yet. Nothing but segment and hint files is accepted; on failure dir
+// is removed again.
+func Restore(r io.Reader, dir string) (err error) {
+	if err := os.Mkdir(dir, defaultDirMode); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := header.Name
+		if header.Typeflag != tar.TypeReg || name != filepath.Base(name) ||
+			!(strings.HasPrefix(name, segmentPrefix) || strings.HasPrefix(name, hintPrefix)) {
+			return fmt.Errorf("restore: unexpected archive entry %q", name)
+		}
+		perm := os.FileMode(header.Mode).Perm()
+		if perm == 0 {
+			perm = defaultFileMode
+		}
+		if err := writeFileFrom(filepath.Join(dir, name), tr, perm); err != nil {
+			return fmt.Errorf("restore %s: %w", name, err)
+		}
+	}
+	return syncDir(dir)
+}
+
+func writeFileFrom(path string, r io.Reader, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func copyPrefix(w io.Writer, path string, size int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := io.CopyN(w, src, size); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// copyFilePrefix copies the first size bytes of src into a new file dst.
+func copyFilePrefix(src, dst string, size int64, perm os.FileMode) error {
+	file, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := copyPrefix(file, src, size); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
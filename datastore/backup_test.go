@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 256, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), "before"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	// Writers keep going while the checkpoint is taken.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Put(fmt.Sprintf("k%d", i%20), "after"); err != nil {
+				t.Errorf("Failed to put: %v", err)
+				return
+			}
+		}
+	}()
+
+	cpDir := filepath.Join(dir, "checkpoint")
+	err = db.Checkpoint(cpDir)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if err := db.Checkpoint(cpDir); err == nil {
+		t.Errorf("Expected checkpoint into an existing directory to fail")
+	}
+
+	cp, err := Open(cpDir)
+	if err != nil {
+		t.Fatalf("Failed to open checkpoint: %v", err)
+	}
+	defer cp.Close()
+	for i := 0; i < 20; i++ {
+		value, err := cp.Get(fmt.Sprintf("k%d", i))
+		if err != nil || (value != "before" && value != "after") {
+			t.Errorf("Unexpected value of k%d in checkpoint: %q, %v", i, value, err)
+		}
+	}
+}
+
+func TestRestoreRejectsForeignEntries(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../" + segmentPrefix + "1", Mode: 0o600}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := Restore(buf, restored); err == nil {
+		t.Errorf("Expected an entry outside the data directory to be rejected")
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Errorf("Expected the failed restore to clean up, got %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 128, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := db.Backup(buf); err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	if err := db.Put("late", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := Restore(bytes.NewReader(buf.Bytes()), restored); err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+	if err := Restore(bytes.NewReader(buf.Bytes()), restored); err == nil {
+		t.Errorf("Expected restore into an existing directory to fail")
+	}
+
+	backup, err := Open(restored)
+	if err != nil {
+		t.Fatalf("Failed to open restored backup: %v", err)
+	}
+	defer backup.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := backup.Get(fmt.Sprintf("k%d", i)); err != nil {
+			t.Errorf("Failed to get k%d from backup: %v", i, err)
+		}
+	}
+	if _, err := backup.Get("late"); err != ErrNotFound {
+		t.Errorf("Expected a write made after the backup to be missing, got %v", err)
+	}
+}
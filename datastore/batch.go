@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Batch collects writes to be applied atomically by Db.Write: after a crash
+// either all of them are visible or none is. The zero value is an empty
+// batch ready to use.
+type Batch struct {
+	records []record
+}
+
+func (b *Batch) Put(key, value string) {
+	b.records = append(b.records, *NewStringRecord(key, value))
+}
+
+func (b *Batch) PutInt64(key string, value int64) {
+	b.records = append(b.records, *NewInt64Record(key, value))
+}
+
+func (b *Batch) PutBytes(key string, value []byte) {
+	b.records = append(b.records, *NewBytesRecord(key, value))
+}
+
+func (b *Batch) PutFloat64(key string, value float64) {
+	b.records = append(b.records, *NewFloat64Record(key, value))
+}
+
+func (b *Batch) PutBool(key string, value bool) {
+	b.records = append(b.records, *NewBoolRecord(key, value))
+}
+
+// PutJSON adds a JSON document; Write fails if it is not valid JSON.
+func (b *Batch) PutJSON(key string, value json.RawMessage) {
+	b.records = append(b.records, *NewJSONRecord(key, value))
+}
+
+// PutValue adds a value of any type Db.GetValue can return.
+func (b *Batch) PutValue(key string, value any) error {
+	rec, err := newValueRecord(key, value)
+	if err != nil {
+		return err
+	}
+	b.records = append(b.records, *rec)
+	return nil
+}
+
+// PutValueUntil adds a value like PutValue that expires at expiresAt; the
+// zero time means it never does.
+func (b *Batch) PutValueUntil(key string, value any, expiresAt time.Time) error {
+	rec, err := newValueRecord(key, value)
+	if err != nil {
+		return err
+	}
+	if !expiresAt.IsZero() {
+		rec.expiresAt = expiresAt.UnixNano()
+	}
+	b.records = append(b.records, *rec)
+	return nil
+}
+
+func (b *Batch) Delete(key string) {
+	b.records = append(b.records, *NewTombstoneRecord(key))
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.records)
+}
+
+// Write applies every write of the batch in order. The records land in the
+// current segment in one piece followed by a commit marker; index rebuild
+// ignores batch records that are not followed by their marker.
+func (db *Db) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	return db.commit(func() error {
+		// Sequence numbers are handed out under the lock, so the records
+		// are encoded here rather than up front.
+		buf := &bytes.Buffer{}
+		sizes := make([]int64, len(b.records))
+		seq := db.lastSeq
+		for i, rec := range b.records {
+			seq++
+			rec.seq = seq
+			rec.flags |= flagBatch
+			rec.compressThreshold = db.opts.CompressionThreshold
+			data, err := rec.Encode()
+			if err != nil {
+				return err
+			}
+			sizes[i] = int64(len(data))
+			buf.Write(data)
+		}
+		commit := record{value: int64(len(b.records)), dataType: dataTypeBatchCommit}
+		data, err := commit.Encode()
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+
+		offset, err := db.appendLocked(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		first := db.lastSeq + 1
+		db.lastSeq = seq
+
+		seg := segment{db.currentSegment.Name()}
+		for i, rec := range b.records {
+			pos := recordPosition{
+				segment:   seg,
+				offset:    offset,
+				size:      sizes[i],
+				tombstone: rec.dataType == DataTypeTombstone,
+				expiresAt: rec.expiresAt,
+			}
+			offset += sizes[i]
+
+			db.currentIndex[rec.key] = pos
+			rec.seq = first + uint64(i)
+			db.publishLocked(&rec)
+			if pos.tombstone {
+				db.deleteIndexLocked(rec.key)
+			} else {
+				db.setIndexLocked(rec.key, pos)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBatchWrite(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	func() {
+		db, err := Open(dir)
+		if err != nil {
+			t.Fatalf("Failed to open db: %v", err)
+		}
+		defer db.Close()
+
+		if err := db.Put("removed", "v"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+
+		var b Batch
+		b.Put("name", "Alice")
+		b.PutInt64("age", 30)
+		b.Put("name", "Bob")
+		b.Delete("removed")
+		if err := db.Write(&b); err != nil {
+			t.Fatalf("Failed to write batch: %v", err)
+		}
+
+		assertBatchApplied(t, db)
+	}()
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	assertBatchApplied(t, db)
+}
+
+func assertBatchApplied(t *testing.T, db *Db) {
+	t.Helper()
+	if value, err := db.Get("name"); err != nil || value != "Bob" {
+		t.Errorf("Expected Bob, got %q, %v", value, err)
+	}
+	if value, err := db.GetInt64("age"); err != nil || value != 30 {
+		t.Errorf("Expected 30, got %d, %v", value, err)
+	}
+	if _, err := db.Get("removed"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+}
+
+func TestBatchWithoutCommitIsIgnored(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k1", "before"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	sizeBefore := db.currentOffset
+
+	var b Batch
+	b.Put("k1", "after")
+	b.Put("k2", "after")
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	segPath := db.currentSegment.Name()
+	sizeAfter := db.currentOffset
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	// Simulate a crash that lost the commit marker.
+	commit := record{value: int64(2), dataType: dataTypeBatchCommit}
+	data, err := commit.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segPath, sizeAfter-int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	if value, err := db.Get("k1"); err != nil || value != "before" {
+		t.Errorf("Expected value from before the batch, got %q, %v", value, err)
+	}
+	if _, err := db.Get("k2"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for uncommitted key, got %v", err)
+	}
+	if sizeBefore >= sizeAfter {
+		t.Errorf("Expected the batch to have been written")
+	}
+}
+
+func TestCompactCommittedBatch(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	var b Batch
+	b.Put("k1", "v1")
+	b.Put("k2", "v2")
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	// The compacted segment holds plain records without a commit marker.
+	scan, err := scanSegment(db.segments[0].name, true)
+	if err != nil {
+		t.Fatalf("Failed to scan compacted segment: %v", err)
+	}
+	if len(scan.index) != 2 {
+		t.Errorf("Expected 2 records in compacted segment, got %d", len(scan.index))
+	}
+	for _, key := range []string{"k1", "k2"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Failed to get %s after compaction: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCompactionRunning = fmt.Errorf("compaction is already running")
+	ErrCompactionPaused  = fmt.Errorf("compaction is paused")
+)
+
+// CompactionWindow is a daily period of local time in which automatic
+// compaction may run. A window whose End is before its Start wraps past
+// midnight.
+type CompactionWindow struct {
+	// Start and End are offsets from midnight.
+	Start, End time.Duration
+}
+
+func (w CompactionWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	if w.Start <= w.End {
+		return now >= w.Start && now < w.End
+	}
+	return now >= w.Start || now < w.End
+}
+
+func (w CompactionWindow) String() string {
+	return formatClock(w.Start) + "-" + formatClock(w.End)
+}
+
+func formatClock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// ParseCompactionWindow is the inverse of CompactionWindow.String: it
+// reads a window such as "22:30-04:00".
+func ParseCompactionWindow(s string) (CompactionWindow, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return CompactionWindow{}, fmt.Errorf("compaction window %q is not of the form hh:mm-hh:mm", s)
+	}
+	var w CompactionWindow
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return CompactionWindow{}, fmt.Errorf("compaction window %q: %w", s, err)
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return CompactionWindow{}, fmt.Errorf("compaction window %q: %w", s, err)
+	}
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// compactionControl holds the switches of compaction that are independent
+// of the segments it works on.
+type compactionControl struct {
+	mu     sync.Mutex
+	paused bool
+	// cancel stops the running compaction, nil if none runs.
+	cancel context.CancelFunc
+
+	runs     int
+	failures int
+	last     *CompactionResult
+	// lastErr is the error of the latest failed run, cleared by a
+	// successful one.
+	lastErr error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// begin registers the cancel function of a compaction about to run.
+func (c *compactionControl) begin(cancel context.CancelFunc) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return ErrCompactionPaused
+	}
+	c.cancel = cancel
+	return nil
+}
+
+func (c *compactionControl) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel = nil
+}
+
+func (c *compactionControl) isPaused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// CompactionResult describes a finished compaction run.
+type CompactionResult struct {
+	Start    time.Time
+	Duration time.Duration
+	// Segments is the number of segments merged.
+	Segments int
+	// BytesBefore is the size of the merged segments, BytesAfter the size
+	// of the segment that replaced them.
+	BytesBefore int64
+	BytesAfter  int64
+	// RecordsKept counts the keys carried over into the new segment and
+	// RecordsDropped the keys of the merged segments left behind because
+	// they were deleted, expired or overwritten since.
+	RecordsKept    int
+	RecordsDropped int
+	// Err is why the run failed or was abandoned, nil if it succeeded.
+	Err error
+}
+
+// Failed reports whether the run failed, as opposed to succeeding or being
+// cancelled.
+func (r CompactionResult) Failed() bool {
+	return r.Err != nil && !errors.Is(r.Err, context.Canceled)
+}
+
+// recordCompaction keeps result for Stats and passes it to the
+// OnCompaction hook.
+func (db *Db) recordCompaction(result CompactionResult) {
+	c := &db.compaction
+	c.mu.Lock()
+	c.runs++
+	c.last = &result
+	switch {
+	case result.Failed():
+		c.failures++
+		c.lastErr = result.Err
+	case result.Err == nil:
+		c.lastErr = nil
+	}
+	c.mu.Unlock()
+
+	if result.Failed() {
+		db.logf("datastore: compaction failed: %v", result.Err)
+	}
+	if db.opts.OnCompaction != nil {
+		db.opts.OnCompaction(result)
+	}
+}
+
+// PauseCompaction stops the running compaction, if any, and keeps new ones
+// from starting until ResumeCompaction is called. Dead space keeps piling
+// up in the meantime.
+func (db *Db) PauseCompaction() {
+	c := &db.compaction
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// ResumeCompaction undoes PauseCompaction. Dirty segments are picked up at
+// the next rotation or scheduled check.
+func (db *Db) ResumeCompaction() {
+	c := &db.compaction
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+}
+
+// Compact seals the current segment and merges every sealed segment into
+// one, reclaiming all dead space. It runs regardless of the compaction
+// windows. It fails with ErrCompactionRunning while another compaction is
+// in progress and with ErrCompactionPaused while compaction is paused.
+// Cancelling ctx abandons the merge and leaves the database as it was.
+func (db *Db) Compact(ctx context.Context) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.compaction.isPaused() {
+		return ErrCompactionPaused
+	}
+	if db.compacting.Load() {
+		return ErrCompactionRunning
+	}
+
+	db.mu.Lock()
+	var err error
+	if db.currentOffset > 0 {
+		err = db.rotateSegmentLocked()
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return db.compactSegments(ctx, nil, 0)
+}
+
+// inCompactionWindow reports whether automatic compaction may run at t.
+func (db *Db) inCompactionWindow(t time.Time) bool {
+	if len(db.opts.CompactionWindows) == 0 {
+		return true
+	}
+	for _, w := range db.opts.CompactionWindows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compactDirty merges the dirty sealed segments in the background if there
+// are at least min of them and automatic compaction may run.
+func (db *Db) compactDirty(min int) {
+	if db.compaction.isPaused() || !db.inCompactionWindow(time.Now()) {
+		return
+	}
+	db.mu.RLock()
+	dirty := db.dirtySegmentsLocked()
+	db.mu.RUnlock()
+	if len(dirty) == 0 || len(dirty) < min {
+		return
+	}
+
+	// recordCompaction reports failures.
+	_ = db.compactSegments(context.Background(), dirty, 0)
+}
+
+// startCompactionScheduler checks for dirty segments every
+// CompactionInterval while in a compaction window, so that databases too
+// quiet to rotate segments still get compacted.
+func (db *Db) startCompactionScheduler() {
+	c := &db.compaction
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	if db.readOnly.Load() || len(db.opts.CompactionWindows) == 0 {
+		close(c.done)
+		return
+	}
+
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(db.opts.CompactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.compactDirty(1)
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (db *Db) stopCompactionScheduler() {
+	close(db.compaction.stop)
+	<-db.compaction.done
+}
+
+// CompactionStatus describes the state of compaction at one point in time.
+type CompactionStatus struct {
+	Running bool
+	Paused  bool
+	// InWindow reports whether automatic compaction may run now.
+	InWindow bool
+	// DirtySegments is the number of sealed segments with at least the
+	// GarbageRatio of dead bytes.
+	DirtySegments int
+}
+
+func (db *Db) CompactionStatus() CompactionStatus {
+	db.mu.RLock()
+	dirty := len(db.dirtySegmentsLocked())
+	db.mu.RUnlock()
+
+	return CompactionStatus{
+		Running:       db.compacting.Load(),
+		Paused:        db.compaction.isPaused(),
+		InWindow:      db.inCompactionWindow(time.Now()),
+		DirtySegments: dirty,
+	}
+}
@@ -0,0 +1,438 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompactOnDemand(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	// Nothing rotates, so only Compact can reclaim the overwritten values.
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if err := db.Put("k", value); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	if len(db.segments) != 1 {
+		t.Errorf("Expected 1 sealed segment, got %d", len(db.segments))
+	}
+	if db.currentOffset != 0 {
+		t.Errorf("Expected a fresh current segment, got offset %d", db.currentOffset)
+	}
+	stats := db.Stats()
+	if stats.Keys != 1 || stats.Segments[0].LiveKeys != 1 {
+		t.Errorf("Expected the one key in the compacted segment, got %+v", stats)
+	}
+	if value, err := db.Get("k"); err != nil || value != "v3" {
+		t.Errorf("Expected v3, got %q, %v", value, err)
+	}
+
+	// A second run finds nothing to seal and merges the single segment.
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact again: %v", err)
+	}
+	if value, err := db.Get("k"); err != nil || value != "v3" {
+		t.Errorf("Expected v3 after compacting twice, got %q, %v", value, err)
+	}
+}
+
+func TestCompactCancelled(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Compact(ctx); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// The sealed segment is untouched and no merge output is left behind.
+	files, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	if len(files) != 2 || len(db.segments) != 1 {
+		t.Errorf("Expected the sealed and the current segment only, got %v", files)
+	}
+	if value, err := db.Get("k"); err != nil || value != "v" {
+		t.Errorf("Expected v, got %q, %v", value, err)
+	}
+	if db.CompactionStatus().Running {
+		t.Errorf("Expected no compaction to be running")
+	}
+}
+
+func TestPauseCompaction(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 100, 1)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	db.PauseCompaction()
+	if !db.CompactionStatus().Paused {
+		t.Errorf("Expected paused status")
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("k", "value"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	db.compactDirty(1)
+	if status := db.CompactionStatus(); status.DirtySegments < 2 {
+		t.Errorf("Expected dirty segments to pile up while paused, got %+v", status)
+	}
+	if err := db.Compact(context.Background()); err != ErrCompactionPaused {
+		t.Errorf("Expected ErrCompactionPaused, got %v", err)
+	}
+
+	db.ResumeCompaction()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact after resuming: %v", err)
+	}
+	if status := db.CompactionStatus(); status.Paused || status.DirtySegments != 0 {
+		t.Errorf("Expected compaction to catch up, got %+v", status)
+	}
+}
+
+func TestCompactionWindows(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	at := func(hour, min int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+
+	night, err := ParseCompactionWindow("22:30-04:00")
+	if err != nil {
+		t.Fatalf("Failed to parse window: %v", err)
+	}
+	if night.String() != "22:30-04:00" {
+		t.Errorf("Expected the window to print as parsed, got %s", night)
+	}
+	lunch, err := ParseCompactionWindow("12:00-13:00")
+	if err != nil {
+		t.Fatalf("Failed to parse window: %v", err)
+	}
+
+	for _, tc := range []struct {
+		w    CompactionWindow
+		t    time.Time
+		want bool
+	}{
+		{night, at(23, 0), true},
+		{night, at(3, 59), true},
+		{night, at(4, 0), false},
+		{night, at(12, 0), false},
+		{lunch, at(12, 0), true},
+		{lunch, at(13, 0), false},
+		{lunch, at(22, 45), false},
+	} {
+		if got := tc.w.contains(tc.t); got != tc.want {
+			t.Errorf("%s contains %s: expected %v, got %v", tc.w, tc.t.Format("15:04"), tc.want, got)
+		}
+	}
+
+	for _, bad := range []string{"", "12:00", "25:00-01:00", "1200-1300"} {
+		if _, err := ParseCompactionWindow(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestScheduledCompaction(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	later := now.Sub(midnight) + 2*time.Hour
+	outside := CompactionWindow{Start: later % (24 * time.Hour), End: (later + time.Hour) % (24 * time.Hour)}
+
+	db, err := OpenWithOptions(dir, Options{
+		MaxSegmentSize:      100,
+		CompactionThreshold: 1,
+		CompactionWindows:   []CompactionWindow{outside},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("k", "value"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	db.compactDirty(1)
+	status := db.CompactionStatus()
+	if status.InWindow || status.DirtySegments < 2 {
+		t.Errorf("Expected no compaction outside the window, got %+v", status)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	// A window spanning the whole day lets the scheduler catch up without
+	// any further writes.
+	db, err = OpenWithOptions(dir, Options{
+		CompactionThreshold: 100,
+		CompactionWindows:   []CompactionWindow{{Start: 0, End: 24 * time.Hour}},
+		CompactionInterval:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for db.CompactionStatus().DirtySegments > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the scheduler to compact the dirty segments")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if value, err := db.Get("k"); err != nil || value != "value" {
+		t.Errorf("Expected value, got %q, %v", value, err)
+	}
+}
+
+func TestCompactionResults(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	var results []CompactionResult
+	db, err := OpenWithOptions(dir, Options{
+		CompactionThreshold: 100,
+		OnCompaction: func(result CompactionResult) {
+			results = append(results, result)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k1", "k3"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := db.Delete("k3"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Expected the hook to see 1 run, got %d", len(results))
+	}
+	result := results[0]
+	if result.Err != nil || result.Segments != 1 || result.RecordsKept != 2 || result.RecordsDropped != 1 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if result.BytesAfter >= result.BytesBefore || result.Duration <= 0 {
+		t.Errorf("Expected the merge to shrink the data, got %+v", result)
+	}
+	stats := db.Stats()
+	if stats.Compactions != 1 || stats.CompactionFailures != 0 || stats.CompactionError != nil {
+		t.Errorf("Unexpected compaction stats: %+v", stats)
+	}
+	if stats.LastCompaction == nil || stats.LastCompaction.BytesAfter != result.BytesAfter {
+		t.Errorf("Expected the last run in stats, got %+v", stats.LastCompaction)
+	}
+
+	// Taking the name the merge output needs makes the next run fail.
+	if err := db.Put("k1", "other"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	ts, err := segmentTimestamp(db.currentSegment.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker := filepath.Join(dir, segmentPrefix+strconv.FormatInt(ts+1, 10))
+	if err := os.Mkdir(blocker, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err == nil {
+		t.Fatalf("Expected compaction to fail")
+	}
+	stats = db.Stats()
+	if stats.Compactions != 2 || stats.CompactionFailures != 1 || stats.CompactionError == nil {
+		t.Errorf("Expected the failure in stats, got %+v", stats)
+	}
+	if len(results) != 2 || !results[1].Failed() {
+		t.Errorf("Expected the hook to see the failure, got %+v", results)
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if stats := db.Stats(); stats.CompactionFailures != 1 || stats.CompactionError != nil {
+		t.Errorf("Expected a successful run to clear the error, got %+v", stats)
+	}
+	if value, err := db.Get("k1"); err != nil || value != "other" {
+		t.Errorf("Expected other, got %q, %v", value, err)
+	}
+}
+
+func TestCompactionUnderConcurrentLoad(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := Options{MaxSegmentSize: 512, CompactionThreshold: 1}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	const (
+		writers = 4
+		keys    = 20
+		ops     = 400
+	)
+	// models[w] is what writer w expects its keys to hold, "" if deleted.
+	models := make([]map[string]string, writers)
+	done := make(chan struct{})
+	var wg, background sync.WaitGroup
+
+	for w := range writers {
+		models[w] = make(map[string]string)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			model := models[w]
+			for i := range ops {
+				key := fmt.Sprintf("w%d-%d", w, rand.IntN(keys))
+				if i%5 == 4 && model[key] != "" {
+					if err := db.Delete(key); err != nil {
+						t.Errorf("Failed to delete %s: %v", key, err)
+						return
+					}
+					model[key] = ""
+				} else {
+					value := fmt.Sprintf("%s=%d", key, i)
+					if err := db.Put(key, value); err != nil {
+						t.Errorf("Failed to put %s: %v", key, err)
+						return
+					}
+					model[key] = value
+				}
+				value, err := db.Get(key)
+				if model[key] == "" && err != ErrNotFound || model[key] != "" && value != model[key] {
+					t.Errorf("Read of %s: expected %q, got %q, %v", key, model[key], value, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Readers of other writers' keys only see values written for the key.
+	for range 2 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("w%d-%d", rand.IntN(writers), rand.IntN(keys))
+				value, err := db.Get(key)
+				if err != nil && err != ErrNotFound || err == nil && !strings.HasPrefix(value, key+"=") {
+					t.Errorf("Read of %s: got %q, %v", key, value, err)
+					return
+				}
+			}
+		}()
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.Compact(context.Background()); err != nil && err != ErrCompactionRunning {
+				t.Errorf("Failed to compact: %v", err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	background.Wait()
+
+	check := func() {
+		t.Helper()
+		for _, model := range models {
+			for key, want := range model {
+				value, err := db.Get(key)
+				if want == "" && err != ErrNotFound || want != "" && value != want {
+					t.Errorf("Expected %s=%q, got %q, %v", key, want, value, err)
+				}
+			}
+		}
+	}
+	check()
+
+	// The accounting kept through all merges matches the index.
+	stats := db.Stats()
+	if stats.Compactions == 0 {
+		t.Errorf("Expected compactions to run during the test")
+	}
+	db.mu.RLock()
+	live := make(map[string]int64)
+	for _, pos := range db.index {
+		live[pos.segment.name] += pos.size
+	}
+	db.mu.RUnlock()
+	for _, s := range stats.Segments {
+		if s.LiveBytes != live[s.Path] {
+			t.Errorf("Segment %s: accounted %d live bytes, index has %d", s.Path, s.LiveBytes, live[s.Path])
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	db, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	check()
+}
@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordCompression(t *testing.T) {
+	large := strings.Repeat(`{"name":"value"},`, 100)
+
+	t.Run("large value", func(t *testing.T) {
+		r := NewStringRecord("key", large)
+		r.compressThreshold = 64
+		encoded, err := r.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) >= len(large) {
+			t.Errorf("Expected compressed record smaller than %d bytes, got %d", len(large), len(encoded))
+		}
+
+		var decoded record
+		if err := decoded.Decode(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.flags&flagCompressed == 0 || decoded.value != large {
+			t.Errorf("Expected compressed record to decode to the original value")
+		}
+	})
+
+	t.Run("below threshold", func(t *testing.T) {
+		r := NewStringRecord("key", large)
+		r.compressThreshold = len(large) + 1
+		encoded, err := r.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded[legacyHeaderSize]&flagCompressed != 0 {
+			t.Errorf("Expected value below threshold to stay uncompressed")
+		}
+	})
+
+	t.Run("incompressible value", func(t *testing.T) {
+		random := make([]byte, 256)
+		rand.Read(random)
+		r := NewBytesRecord("key", random)
+		r.compressThreshold = 1
+		encoded, err := r.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded[legacyHeaderSize]&flagCompressed != 0 {
+			t.Errorf("Expected incompressible value to stay uncompressed")
+		}
+	})
+}
+
+func TestCompactRecompresses(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	large := strings.Repeat("abcdefgh", 512)
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k", large); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	db, err = OpenWithOptions(dir, Options{CompressionThreshold: 1024})
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	before, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	after, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before/2 {
+		t.Errorf("Expected compaction to compress %d bytes well, got %d", before, after)
+	}
+
+	if value, err := db.Get("k"); err != nil || value != large {
+		t.Errorf("Expected the original value after recompression, got %d bytes, %v", len(value), err)
+	}
+}
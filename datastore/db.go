@@ -2,11 +2,15 @@ package datastore
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,15 +21,28 @@ import (
 
 const (
 	segmentPrefix              = "segment-"
+	lockFileName               = "LOCK"
 	defaultMaxSegmentSize      = 10 * 1024 * 1024
 	defaultCompactionThreshold = 3
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound     = fmt.Errorf("record does not exist")
+	ErrTypeMismatch = fmt.Errorf("value has a different type")
+)
 
 type recordPosition struct {
-	segment segment
-	offset  int64
+	segment   segment
+	offset    int64
+	size      int64
+	tombstone bool
+	// expiresAt mirrors the expiry of the record, zero if it has none.
+	expiresAt int64
+}
+
+// expired reports whether the record at pos is gone by now.
+func (pos recordPosition) expired(now time.Time) bool {
+	return pos.expiresAt != 0 && now.UnixNano() >= pos.expiresAt
 }
 
 type index = map[string]recordPosition
@@ -37,73 +54,146 @@ type segment struct {
 type Db struct {
 	compacting atomic.Bool
 	compacted  *sync.Cond
+	compaction compactionControl
 	mu         sync.RWMutex
 
-	compactionThreshold int64
-	maxSegmentSize      int64
+	opts Options
+	// readOnly starts out as Options.ReadOnly and is cleared by Promote.
+	readOnly atomic.Bool
+
+	group    groupCommit
+	syncStop chan struct{}
+	syncDone chan struct{}
 
 	currentSegment *os.File
 	currentOffset  int64
-	dir            string
-	segments       []segment
-	index          index
+	// currentIndex holds every position written to the current segment,
+	// tombstones included, for the hint file written once it is sealed.
+	currentIndex index
+	dir          string
+	segments     []segment
+	index        index
+	// usage holds the live and total bytes of every segment, keyed by
+	// segment name.
+	usage map[string]*segmentUsage
+	// lastSeq is the sequence number of the newest write.
+	lastSeq uint64
+
+	// pins counts open snapshots reading segment files without holding mu.
+	// Segments retired by compaction stay on disk in obsolete until the
+	// last pin is released. Pins are taken holding mu for reading at least
+	// and released holding it for writing.
+	pins     atomic.Int64
+	obsolete []segment
+	// dropped holds the segments a follower removes itself once they are
+	// obsolete, as its leader has compacted them away.
+	dropped map[string]bool
+
+	readers     segmentReaders
+	subscribers subscribers
+
+	// lock holds the directory lock of a writable Db.
+	lock *os.File
+	// tail is the offset up to which a read-only Db has applied the newest
+	// segment, which the writer may still be appending to.
+	tail        int64
+	refreshStop chan struct{}
+	refreshDone chan struct{}
 }
 
+var (
+	ErrReadOnly = fmt.Errorf("database is read-only")
+	ErrLocked   = fmt.Errorf("database directory is locked by another writer")
+)
+
 func Open(dir string) (*Db, error) {
-	return open(dir, defaultMaxSegmentSize, defaultCompactionThreshold)
+	return OpenWithOptions(dir, Options{})
 }
 
-func open(dir string, maxSegmentSize int64, compactionThreshold int64) (*Db, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
+func open(dir string, maxSegmentSize int64, compactionThreshold int) (*Db, error) {
+	return OpenWithOptions(dir, Options{
+		MaxSegmentSize:      maxSegmentSize,
+		CompactionThreshold: compactionThreshold,
+	})
+}
+
+func newDb(dir string, opts Options) (*Db, error) {
+	opts = opts.withDefaults()
+	if opts.ReadOnly {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(dir, opts.DirMode); err != nil {
 		return nil, err
 	}
 
 	db := &Db{
-		index:               make(map[string]recordPosition),
-		dir:                 dir,
-		maxSegmentSize:      maxSegmentSize,
-		compactionThreshold: compactionThreshold,
+		index: make(map[string]recordPosition),
+		usage: make(map[string]*segmentUsage),
+		dir:   dir,
+		opts:  opts,
 	}
 	db.compacted = sync.NewCond(&db.mu)
+	db.readOnly.Store(opts.ReadOnly)
 
+	if !opts.ReadOnly {
+		lock, err := lockDir(dir, opts.FileMode)
+		if err != nil {
+			return nil, err
+		}
+		db.lock = lock
+	}
 	if err := db.loadSegments(); err != nil {
+		db.unlock()
 		return nil, err
 	}
 
-	if err := db.rebuildIndexLocked(); err != nil && err != io.EOF {
-		return nil, err
-	}
+	return db, nil
+}
 
-	if err := db.createCurrentSegmentLocked(); err != nil {
-		return nil, err
+// unlock releases the directory lock, if any.
+func (db *Db) unlock() {
+	if db.lock != nil {
+		db.lock.Close()
+		db.lock = nil
 	}
-
-	return db, nil
 }
 
 func (db *Db) loadSegments() error {
-	files, err := filepath.Glob(filepath.Join(db.dir, segmentPrefix+"*"))
+	paths, err := SegmentFiles(db.dir)
 	if err != nil {
 		return err
 	}
 
+	db.segments = make([]segment, len(paths))
+	for i, path := range paths {
+		db.segments[i] = segment{path}
+	}
+
+	return nil
+}
+
+// SegmentFiles returns the paths of the segment files in dir, oldest first.
+func SegmentFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
 	var segs []struct {
-		segment   segment
+		path      string
 		timestamp int64
 	}
 
 	for _, file := range files {
-		base := filepath.Base(file)
-		tsStr := strings.TrimPrefix(base, segmentPrefix)
-		ts, err := strconv.ParseInt(tsStr, 10, 64)
+		ts, err := segmentTimestamp(file)
 		if err != nil {
 			continue // Skip files that don't match our timestamp format
 		}
-		seg := segment{file}
 		segs = append(segs, struct {
-			segment   segment
+			path      string
 			timestamp int64
-		}{seg, ts})
+		}{file, ts})
 	}
 
 	// Sort by timestamp (oldest first)
@@ -111,18 +201,30 @@ func (db *Db) loadSegments() error {
 		return segs[i].timestamp < segs[j].timestamp
 	})
 
-	db.segments = make([]segment, len(segs))
+	paths := make([]string, len(segs))
 	for i, seg := range segs {
-		db.segments[i] = seg.segment
+		paths[i] = seg.path
 	}
 
-	return nil
+	return paths, nil
+}
+
+// segmentTimestamp returns the timestamp a segment file is named after.
+func segmentTimestamp(path string) (int64, error) {
+	return strconv.ParseInt(strings.TrimPrefix(filepath.Base(path), segmentPrefix), 10, 64)
 }
 
 func (db *Db) createCurrentSegmentLocked() error {
 	ts := time.Now().UnixNano()
+	if len(db.segments) > 0 {
+		// Segments may come from another machine whose clock is ahead, as
+		// after promoting a follower; the new one must still sort last.
+		if last, err := segmentTimestamp(db.segments[len(db.segments)-1].name); err == nil && ts <= last {
+			ts = last + 1
+		}
+	}
 	segPath := filepath.Join(db.dir, segmentPrefix+strconv.FormatInt(ts, 10))
-	file, err := os.OpenFile(segPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	file, err := os.OpenFile(segPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, db.opts.FileMode)
 	if err != nil {
 		return err
 	}
@@ -133,105 +235,264 @@ func (db *Db) createCurrentSegmentLocked() error {
 		return err
 	}
 	db.currentOffset = stat.Size()
+	db.currentIndex = make(index)
+	db.usageLocked(segment{segPath}).size = db.currentOffset
 
 	return nil
 }
 
 func (db *Db) rebuildIndexLocked() error {
-	db.index = make(index)
+	db.resetIndexLocked()
 
-	for _, seg := range db.segments {
-		if err := db.rebuildIndexFromPathLocked(seg.name); err != nil {
+	for i, seg := range db.segments {
+		if db.readOnly.Load() && i == len(db.segments)-1 {
+			// The writer may still be appending to it.
+			db.tail = 0
+			return db.tailLocked()
+		}
+		scan, err := db.loadSegment(seg.name)
+		if err != nil {
 			return err
 		}
+		db.mergeScanLocked(seg, scan)
 	}
 	if db.currentSegment != nil {
-		if err := db.rebuildIndexFromPathLocked(db.currentSegment.Name()); err != nil {
+		seg := segment{db.currentSegment.Name()}
+		scan, err := scanSegment(seg.name, true)
+		if err != nil {
 			return err
 		}
+		db.mergeScanLocked(seg, scan)
 	}
 	return nil
 }
 
-func (db *Db) rebuildIndexFromPathLocked(path string) error {
-	index, err := getIndexFromPath(path)
-	if err != nil {
-		return err
-	}
+// mergeScanLocked is mergeIndexLocked that also keeps track of the highest
+// sequence number seen and of the size of seg, the segment scanned.
+func (db *Db) mergeScanLocked(seg segment, scan segmentScan) {
+	db.usageLocked(seg).size = scan.end
+	db.mergeIndexLocked(scan.index)
+	db.lastSeq = max(db.lastSeq, scan.maxSeq)
+}
+
+// mergeIndexLocked applies the index of a segment newer than all the ones
+// merged so far: its positions win and its tombstones and expired records
+// erase keys.
+func (db *Db) mergeIndexLocked(index index) {
+	now := time.Now()
 	for key, pos := range index {
-		db.index[key] = pos
+		if pos.tombstone || pos.expired(now) {
+			db.deleteIndexLocked(key)
+			continue
+		}
+		db.setIndexLocked(key, pos)
 	}
-	return nil
 }
 
+// getIndexFromPath returns the index of the sealed segment at path, read
+// from its hint file when a valid one exists.
 func getIndexFromPath(path string) (index, error) {
-	file, err := os.Open(path)
+	if hint, err := readHintFile(path); err == nil {
+		return hint.index, nil
+	}
+
+	scan, err := scanSegment(path, true)
 	if err != nil {
 		return nil, err
 	}
+	return scan.index, nil
+}
+
+// loadSegment reads the index and maxSeq of the sealed segment at path like
+// getIndexFromPath, and leaves a hint file behind when it had to scan the
+// segment, so the next open does not have to.
+func (db *Db) loadSegment(path string) (segmentScan, error) {
+	if hint, err := readHintFile(path); err == nil {
+		return hint, nil
+	}
+
+	scan, err := scanSegment(path, true)
+	if err != nil {
+		return scan, err
+	}
+	if !db.readOnly.Load() {
+		db.writeHintFile(path, scan)
+	}
+	return scan, nil
+}
+
+// segmentScan is the outcome of walking the records of one segment file.
+type segmentScan struct {
+	index index
+	// bad lists the damaged records met by a lenient scan.
+	bad []RecordError
+	// end is the offset right after the last record the scan could step
+	// over. Anything beyond it is unreadable.
+	end int64
+	// committed is end unless the segment ends in a batch still waiting
+	// for its commit marker; it is then the offset the batch starts at.
+	committed int64
+	// maxSeq is the highest sequence number met.
+	maxSeq uint64
+}
+
+// scanSegment decodes every record of the segment at path. A strict scan
+// fails on the first damaged record. A lenient one collects damaged records
+// and skips them when their length is intact, stopping at the first one it
+// cannot step over.
+func scanSegment(path string, strict bool) (segmentScan, error) {
+	return scanSegmentFrom(path, 0, strict)
+}
+
+// scanSegmentFrom is scanSegment starting at offset from, which must be
+// where a record starts.
+func scanSegmentFrom(path string, from int64, strict bool) (segmentScan, error) {
+	scan := segmentScan{index: make(index), end: from, committed: from}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return scan, err
+	}
 	defer file.Close()
+	if _, err := file.Seek(from, io.SeekStart); err != nil {
+		return scan, err
+	}
 
 	in := bufio.NewReader(file)
-	index := make(map[string]recordPosition)
-	var offset int64
+	// Records of a batch are held back until its commit marker shows up.
+	var batch []pendingRecord
 
 	for {
 		var rec record
 		n, err := rec.DecodeFromReader(in)
 		if errors.Is(err, io.EOF) {
-			if n != 0 {
-				return nil, fmt.Errorf("corrupted segment file %s", path)
-			}
 			break
 		}
 		if err != nil {
-			return nil, err
+			if strict {
+				return scan, fmt.Errorf("corrupted segment file %s: %w", path, err)
+			}
+			scan.bad = append(scan.bad, RecordError{Segment: path, Offset: scan.end, Err: err})
+			if n == 0 || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			scan.end += int64(n)
+			if len(batch) == 0 {
+				scan.committed = scan.end
+			}
+			continue
 		}
 
-		seg := segment{path}
-		index[rec.key] = recordPosition{
-			segment: seg,
-			offset:  offset,
+		pos := recordPosition{
+			segment:   segment{path},
+			offset:    scan.end,
+			size:      int64(n),
+			tombstone: rec.dataType == DataTypeTombstone,
+			expiresAt: rec.expiresAt,
+		}
+		scan.end += int64(n)
+		scan.maxSeq = max(scan.maxSeq, rec.seq)
+
+		switch {
+		case rec.dataType == dataTypeSequence:
+		case rec.flags&flagBatch != 0:
+			batch = append(batch, pendingRecord{rec.key, pos})
+		case rec.dataType == dataTypeBatchCommit:
+			if count, _ := rec.value.(int64); count == int64(len(batch)) {
+				for _, pending := range batch {
+					scan.index[pending.key] = pending.pos
+				}
+			}
+			batch = nil
+		default:
+			// A batch interrupted by a plain record was never committed.
+			batch = nil
+			scan.index[rec.key] = pos
+		}
+		if len(batch) == 0 {
+			scan.committed = scan.end
 		}
-		offset += int64(n)
 	}
-	return index, nil
+	return scan, nil
+}
+
+type pendingRecord struct {
+	key string
+	pos recordPosition
 }
 
 func (db *Db) Close() error {
+	db.stopSyncer()
+	db.stopCompactionScheduler()
+	db.stopRefresher()
+	db.closeSubscriptions()
+	defer db.unlock()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	for !db.compacting.CompareAndSwap(false, true) {
 		db.compacted.Wait()
 	}
+	// Snapshots do not outlive the database: leftover retired segments
+	// would resurrect stale values on the next open.
+	db.removeObsoleteLocked()
+	db.readers.closeAll()
+	if db.currentSegment == nil {
+		return nil
+	}
+	if err := db.currentSegment.Sync(); err != nil {
+		db.currentSegment.Close()
+		return err
+	}
 	return db.currentSegment.Close()
 }
 
 func (db *Db) Get(key string) (string, error) {
-	rec := NewStringRecord(key, "")
-	err := db.get(rec, key)
-	if err != nil {
-		return "", err
-	}
+	return getTyped[string](db, key, DataTypeString)
+}
 
-	value, ok := rec.value.(string)
-	if !ok {
-		return "", fmt.Errorf("invalid value type: expected string")
-	}
+func (db *Db) GetInt64(key string) (int64, error) {
+	return getTyped[int64](db, key, DataTypeInt64)
+}
 
-	return value, nil
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	return getTyped[[]byte](db, key, DataTypeBytes)
 }
 
-func (db *Db) GetInt64(key string) (int64, error) {
-	rec := NewInt64Record(key, 0)
-	err := db.get(rec, key)
-	if err != nil {
-		return 0, err
+func (db *Db) GetFloat64(key string) (float64, error) {
+	return getTyped[float64](db, key, DataTypeFloat64)
+}
+
+func (db *Db) GetBool(key string) (bool, error) {
+	return getTyped[bool](db, key, DataTypeBool)
+}
+
+func (db *Db) GetJSON(key string) (json.RawMessage, error) {
+	return getTyped[json.RawMessage](db, key, DataTypeJSON)
+}
+
+// GetValue returns the value of key whatever its type: a string, int64,
+// []byte, float64, bool or json.RawMessage.
+func (db *Db) GetValue(key string) (any, error) {
+	rec := &record{}
+	if err := db.get(rec, key); err != nil {
+		return nil, err
+	}
+	return rec.value, nil
+}
+
+// getTyped reads key and fails with ErrTypeMismatch unless it holds a value
+// of type dt.
+func getTyped[T any](db *Db, key string, dt DataType) (T, error) {
+	var zero T
+	rec := &record{}
+	if err := db.get(rec, key); err != nil {
+		return zero, err
 	}
 
-	value, ok := rec.value.(int64)
-	if !ok {
-		return 0, fmt.Errorf("invalid value type: expected int64")
+	value, ok := rec.value.(T)
+	if !ok || rec.dataType != dt {
+		return zero, fmt.Errorf("%w: expected %v, got %v", ErrTypeMismatch, dt, rec.dataType)
 	}
 
 	return value, nil
@@ -240,92 +501,211 @@ func (db *Db) GetInt64(key string) (int64, error) {
 func (db *Db) get(rec *record, key string) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	return db.getLocked(rec, key)
+}
 
+// getLocked reads the live record of key into rec. The caller holds mu.
+func (db *Db) getLocked(rec *record, key string) error {
 	pos, ok := db.index[key]
-	if !ok {
+	if !ok || pos.expired(time.Now()) {
 		return ErrNotFound
 	}
 
-	err := getFromPath(rec, pos.segment.name, pos.offset)
-	if err != nil {
-		return err
-	}
+	return db.readRecord(rec, pos)
+}
 
-	return nil
+func (db *Db) Put(key, value string) error {
+	rec := NewStringRecord(key, value)
+	return db.put(*rec)
 }
 
-func getFromPath(rec *record, path string, offset int64) error {
-	file, err := os.Open(path)
+func (db *Db) PutInt64(key string, value int64) error {
+	rec := NewInt64Record(key, value)
+	return db.put(*rec)
+}
+
+func (db *Db) PutBytes(key string, value []byte) error {
+	rec := NewBytesRecord(key, value)
+	return db.put(*rec)
+}
+
+func (db *Db) PutFloat64(key string, value float64) error {
+	rec := NewFloat64Record(key, value)
+	return db.put(*rec)
+}
+
+func (db *Db) PutBool(key string, value bool) error {
+	rec := NewBoolRecord(key, value)
+	return db.put(*rec)
+}
+
+// PutJSON stores a JSON document. It fails if value is not valid JSON.
+func (db *Db) PutJSON(key string, value json.RawMessage) error {
+	rec := NewJSONRecord(key, value)
+	return db.put(*rec)
+}
+
+// PutValue stores a value of any type GetValue can return, picking the
+// data type from its Go type.
+func (db *Db) PutValue(key string, value any) error {
+	rec, err := newValueRecord(key, value)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	return db.put(*rec)
+}
 
-	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+// PutValueWithTTL is PutValue with the expiry of PutWithTTL.
+func (db *Db) PutValueWithTTL(key string, value any, ttl time.Duration) error {
+	rec, err := newValueRecord(key, value)
+	if err != nil {
 		return err
 	}
-
-	if _, err := rec.DecodeFromReader(bufio.NewReader(file)); err != nil {
+	if err := rec.expireAfter(ttl); err != nil {
 		return err
 	}
-
-	return nil
+	return db.put(*rec)
 }
 
-func (db *Db) Put(key, value string) error {
+// PutWithTTL stores value under key for ttl. Once it has passed the key
+// reads as missing and compaction drops the record.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
 	rec := NewStringRecord(key, value)
+	if err := rec.expireAfter(ttl); err != nil {
+		return err
+	}
 	return db.put(*rec)
 }
 
-func (db *Db) PutInt64(key string, value int64) error {
+// PutInt64WithTTL is PutWithTTL for int64 values.
+func (db *Db) PutInt64WithTTL(key string, value int64, ttl time.Duration) error {
 	rec := NewInt64Record(key, value)
+	if err := rec.expireAfter(ttl); err != nil {
+		return err
+	}
 	return db.put(*rec)
 }
 
+func (db *Db) Delete(key string) error {
+	return db.commit(func() error {
+		return db.deleteLocked(key)
+	})
+}
+
+func (db *Db) deleteLocked(key string) error {
+	if pos, ok := db.index[key]; !ok || pos.expired(time.Now()) {
+		return ErrNotFound
+	}
+
+	rec := NewTombstoneRecord(key)
+	if _, err := db.writeLocked(*rec); err != nil {
+		return err
+	}
+	db.deleteIndexLocked(key)
+
+	return nil
+}
+
 func (db *Db) put(rec record) error {
+	return db.commit(func() error {
+		pos, err := db.writeLocked(rec)
+		if err != nil {
+			return err
+		}
+		db.setIndexLocked(rec.key, pos)
+
+		return nil
+	})
+}
+
+// commit runs fn under the write lock, then waits until what fn wrote is
+// as durable as the sync mode promises.
+func (db *Db) commit(fn func() error) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+
 	db.mu.Lock()
-	defer db.mu.Unlock()
+	err := fn()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.waitSync()
+}
 
+// writeLocked appends rec to the current segment and returns its position.
+// The caller is responsible for updating the index.
+func (db *Db) writeLocked(rec record) (recordPosition, error) {
+	db.lastSeq++
+	rec.seq = db.lastSeq
+	rec.compressThreshold = db.opts.CompressionThreshold
 	data, err := rec.Encode()
 	if err != nil {
-		return err
+		return recordPosition{}, err
+	}
+
+	offset, err := db.appendLocked(data)
+	if err != nil {
+		return recordPosition{}, err
 	}
 
-	if db.currentOffset+int64(len(data)) > db.maxSegmentSize {
-		db.triggerRotateLocked()
+	pos := recordPosition{
+		segment:   segment{db.currentSegment.Name()},
+		offset:    offset,
+		size:      int64(len(data)),
+		tombstone: rec.dataType == DataTypeTombstone,
+		expiresAt: rec.expiresAt,
+	}
+	db.currentIndex[rec.key] = pos
+	db.publishLocked(&rec)
+
+	return pos, nil
+}
+
+// appendLocked durably writes data to the current segment, rotating first
+// if data does not fit, and returns the offset data was written at.
+func (db *Db) appendLocked(data []byte) (int64, error) {
+	if db.currentOffset+int64(len(data)) > db.opts.MaxSegmentSize {
+		if err := db.triggerRotateLocked(); err != nil {
+			return 0, err
+		}
 	}
 
 	n, err := db.currentSegment.Write(data)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if err = db.currentSegment.Sync(); err != nil {
-		return err
+	if db.opts.Sync == SyncAlways {
+		if err = db.currentSegment.Sync(); err != nil {
+			return 0, err
+		}
 	}
 
-	seg := segment{db.currentSegment.Name()}
-	db.index[rec.key] = recordPosition{
-		segment: seg,
-		offset:  db.currentOffset,
-	}
+	offset := db.currentOffset
 	db.currentOffset += int64(n)
+	db.usageLocked(segment{db.currentSegment.Name()}).size = db.currentOffset
 
-	return nil
+	return offset, nil
 }
 
 func (db *Db) triggerRotateLocked() error {
-	ts := time.Now().UnixNano()
 	if err := db.rotateSegmentLocked(); err != nil {
 		return err
 	}
-	if len(db.segments) >= int(db.compactionThreshold) {
-		go db.compact(ts)
+	if len(db.dirtySegmentsLocked()) >= db.opts.CompactionThreshold {
+		go db.compactDirty(db.opts.CompactionThreshold)
 	}
 	return nil
 }
 
 func (db *Db) rotateSegmentLocked() error {
+	// Writes waiting for a group commit or a periodic sync may still be
+	// unflushed; a sealed segment is always durable.
+	if err := db.currentSegment.Sync(); err != nil {
+		return err
+	}
 	if err := db.currentSegment.Close(); err != nil {
 		return err
 	}
@@ -333,20 +713,131 @@ func (db *Db) rotateSegmentLocked() error {
 	seg := segment{db.currentSegment.Name()}
 	db.segments = append(db.segments, seg)
 
+	db.writeHintFile(seg.name, segmentScan{
+		index:  db.currentIndex,
+		end:    db.currentOffset,
+		maxSeq: db.lastSeq,
+	})
+	db.mmapSegment(seg.name)
+
 	return db.createCurrentSegmentLocked()
 }
 
+// compact merges every sealed segment into one named after ts, which must
+// sort after all of them.
 func (db *Db) compact(ts int64) error {
+	return db.compactSegments(context.Background(), nil, ts)
+}
+
+// compactSegments merges the live records of segs, or of every sealed
+// segment if segs is nil, into a new segment and retires them. The new
+// segment takes the place of the newest segment merged: it is named after
+// ts, or right after that segment if ts is zero. Cancelling ctx or pausing
+// compaction abandons the merge before anything is installed.
+func (db *Db) compactSegments(ctx context.Context, segs []segment, ts int64) error {
 	if !db.compacting.CompareAndSwap(false, true) {
-		return nil
+		return ErrCompactionRunning
 	}
 	defer func() {
 		db.compacting.Store(false)
 		db.compacted.Broadcast()
 	}()
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := db.compaction.begin(cancel); err != nil {
+		return err
+	}
+	defer db.compaction.end()
+
+	result := CompactionResult{Start: time.Now()}
+	err := db.mergeSegments(ctx, segs, ts, &result)
+	if result.Segments > 0 || err != nil {
+		result.Duration = time.Since(result.Start)
+		result.Err = err
+		db.recordCompaction(result)
+	}
+	return err
+}
+
+// mergeSegments does the work of compactSegments and describes it in
+// result.
+func (db *Db) mergeSegments(ctx context.Context, segs []segment, ts int64, result *CompactionResult) error {
+	db.mu.RLock()
+	segsBefore := slices.Clone(db.segments)
+	db.mu.RUnlock()
+	if segs == nil {
+		segs = segsBefore
+	}
+	// A compaction that finished after segs were picked may have retired
+	// some of them.
+	merged := make(map[segment]bool, len(segs))
+	for _, seg := range segs {
+		merged[seg] = true
+	}
+	// olderSegs are the segments left out of the merge that sort before
+	// the new segment.
+	var mergedSegs, olderSegs, newerSegs []segment
+	for _, seg := range segsBefore {
+		if !merged[seg] {
+			newerSegs = append(newerSegs, seg)
+			continue
+		}
+		mergedSegs = append(mergedSegs, seg)
+		olderSegs = append(olderSegs, newerSegs...)
+		newerSegs = nil
+	}
+	if len(mergedSegs) == 0 {
+		return nil
+	}
+	newest := mergedSegs[len(mergedSegs)-1]
+
+	result.Segments = len(mergedSegs)
+	db.mu.RLock()
+	for _, seg := range mergedSegs {
+		if u, ok := db.usage[seg.name]; ok {
+			result.BytesBefore += u.size
+		}
+	}
+	db.mu.RUnlock()
+
+	if ts == 0 {
+		newestTs, err := segmentTimestamp(newest.name)
+		if err != nil {
+			return err
+		}
+		ts = newestTs + 1
+	}
+	newPath := filepath.Join(db.dir, segmentPrefix+strconv.FormatInt(ts, 10))
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("cannot name compacted segment: %s exists", newPath)
+	}
+
+	// A tombstone or expired record has to keep shadowing its key if an
+	// older segment left out of the merge still holds it.
+	shadowed := make(map[string]bool)
+	for _, seg := range olderSegs {
+		segIndex, err := getIndexFromPath(seg.name)
+		if err != nil {
+			return err
+		}
+		for key := range segIndex {
+			shadowed[key] = true
+		}
+	}
+
+	// The last position of every key within the merged segments.
+	latest := make(index)
+	for _, seg := range mergedSegs {
+		segIndex, err := getIndexFromPath(seg.name)
+		if err != nil {
+			return err
+		}
+		maps.Copy(latest, segIndex)
+	}
+
 	compPath := filepath.Join(db.dir, segmentPrefix+"tmp")
-	comp, err := os.Create(compPath)
+	comp, err := os.OpenFile(compPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, db.opts.FileMode)
 	finished := false
 	if err != nil {
 		return err
@@ -354,99 +845,185 @@ func (db *Db) compact(ts int64) error {
 	defer func() {
 		if !finished {
 			comp.Close()
+			db.readers.release(compPath)
 			os.Remove(compPath)
+			os.Remove(hintPath(compPath))
 		}
 	}()
 
-	segsBefore, indexBefore := db.takeSnapshot()
-	newPath := filepath.Join(db.dir, segmentPrefix+strconv.FormatInt(ts, 10))
+	// Every sequence number handed out so far is at most lastSeq, whatever
+	// the merge drops.
+	db.mu.RLock()
+	maxSeq := db.lastSeq
+	db.mu.RUnlock()
+	compIndex := make(index)
+	var compOffset int64
+	now := time.Now()
+
+	// Reads and writes go on while the merge runs. A key written or
+	// deleted after its record was copied keeps its newer position when
+	// the merge is installed.
+	for key, pos := range latest {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		posLive, live := db.livePosition(key)
+		gone := pos.tombstone || pos.expired(now)
+		switch {
+		case live && pos != posLive:
+			// A newer segment took the key over.
+			continue
+		case !live && !gone:
+			// A newer tombstone deleted the key.
+			continue
+		case gone && !shadowed[key]:
+			continue
+		}
 
-	for _, seg := range segsBefore {
-		segIndex, err := getIndexFromPath(seg.name)
+		rec := &record{}
+		err := db.readRecord(rec, pos)
 		if err != nil {
 			return err
 		}
+		// The batch this record came from is known to be committed.
+		rec.flags &^= flagBatch
+		rec.compressThreshold = db.opts.CompressionThreshold
 
-		for key, pos := range segIndex {
-			posLive, ok := indexBefore[key]
-			if !ok || pos != posLive {
-				continue
-			}
-
-			rec := &record{}
-			err := getFromPath(rec, seg.name, pos.offset)
-			if err != nil {
-				return err
-			}
-
-			data, err := rec.Encode()
-			if err != nil {
-				return err
-			}
+		data, err := rec.Encode()
+		if err != nil {
+			return err
+		}
 
-			_, err = comp.Write(data)
-			if err != nil {
-				return err
-			}
+		n, err := comp.Write(data)
+		if err != nil {
+			return err
+		}
+		compIndex[key] = recordPosition{
+			segment:   segment{newPath},
+			offset:    compOffset,
+			size:      int64(n),
+			tombstone: pos.tombstone,
+			expiresAt: rec.expiresAt,
 		}
+		compOffset += int64(n)
 	}
 
+	marker := record{dataType: dataTypeSequence, seq: maxSeq}
+	data, err := marker.Encode()
+	if err != nil {
+		return err
+	}
+	n, err := comp.Write(data)
+	if err != nil {
+		return err
+	}
+	compOffset += int64(n)
+
 	if err := comp.Close(); err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := os.Rename(compPath, newPath); err != nil {
 		return err
 	}
 	compPath = newPath
-
-	segsAfter, indexAfter := db.takeSnapshot()
+	result.BytesAfter = compOffset
+	result.RecordsKept = len(compIndex)
+	result.RecordsDropped = len(latest) - len(compIndex)
+	db.writeHintFile(newPath, segmentScan{index: compIndex, end: compOffset, maxSeq: maxSeq})
+	db.mmapSegment(newPath)
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	newSegs := []segment{segment{compPath}}
-	newSegs = append(newSegs, db.getNewSegments(segsBefore)...)
-	db.segments = newSegs
-	err = db.rebuildIndexLocked()
-	if err != nil {
-		db.segments = segsAfter
-		db.index = indexAfter
-
-		return fmt.Errorf("failed to rebuild index after compaction: %v", err)
+	var newSegs []segment
+	for _, seg := range db.segments {
+		switch {
+		case seg == newest:
+			newSegs = append(newSegs, segment{compPath})
+		case !merged[seg]:
+			newSegs = append(newSegs, seg)
+		}
 	}
+	db.segments = newSegs
+	db.installMergeLocked(merged, latest, segment{compPath}, compIndex, compOffset)
 
-	for _, segBefore := range segsBefore {
-		os.Remove(segBefore.name)
-	}
+	db.retireSegmentsLocked(mergedSegs)
 	finished = true
 
 	return nil
 }
 
-func (db *Db) getNewSegments(oldSegs []segment) []segment {
-	mapOld := make(map[segment]struct{}, len(oldSegs))
-	for _, oldSeg := range oldSegs {
-		mapOld[oldSeg] = struct{}{}
+// livePosition returns the position the index holds for key.
+func (db *Db) livePosition(key string) (recordPosition, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	pos, ok := db.index[key]
+	return pos, ok
+}
+
+// installMergeLocked moves the keys whose live position is still in one of
+// the merged segments over to out, the merge output of size end indexed by
+// compIndex. latest holds the last position of every key in the merged
+// segments: any key the index has in them is among its keys. A key out has
+// no record for was expired and is dropped.
+func (db *Db) installMergeLocked(merged map[segment]bool, latest index, out segment, compIndex index, end int64) {
+	db.usageLocked(out).size = end
+	for key := range latest {
+		cur, ok := db.index[key]
+		if !ok || !merged[cur.segment] {
+			continue
+		}
+		if pos, ok := compIndex[key]; ok && !pos.tombstone {
+			db.setIndexLocked(key, pos)
+		} else {
+			db.deleteIndexLocked(key)
+		}
 	}
-	var newSegs []segment
-	for _, newSeg := range db.segments {
-		if _, found := mapOld[newSeg]; !found {
-			newSegs = append(newSegs, newSeg)
+	for seg := range merged {
+		delete(db.usage, seg.name)
+	}
+}
+
+// retireSegmentsLocked removes segs from disk once no snapshot can read them.
+func (db *Db) retireSegmentsLocked(segs []segment) {
+	for _, seg := range segs {
+		if !slices.Contains(db.obsolete, seg) {
+			db.obsolete = append(db.obsolete, seg)
 		}
 	}
-	return newSegs
+	if db.pins.Load() == 0 {
+		db.removeObsoleteLocked()
+	}
 }
 
-func (db *Db) takeSnapshot() (segsSnap []segment, indexSnap index) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	segsSnap = make([]segment, len(db.segments))
-	copy(segsSnap, db.segments)
-	indexSnap = make(map[string]recordPosition)
-	for key, pos := range db.index {
-		indexSnap[key] = pos
+func (db *Db) removeObsoleteLocked() {
+	for _, seg := range db.obsolete {
+		db.readers.release(seg.name)
+		if db.readOnly.Load() && !db.dropped[seg.name] {
+			// Only the writer ever removes files, a follower those its
+			// leader has.
+			continue
+		}
+		delete(db.dropped, seg.name)
+		os.Remove(seg.name)
+		os.Remove(hintPath(seg.name))
+	}
+	db.obsolete = nil
+}
+
+func (db *Db) pinSegmentsLocked() {
+	db.pins.Add(1)
+}
+
+func (db *Db) unpinSegments() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pins.Add(-1) == 0 {
+		db.removeObsoleteLocked()
 	}
-	return
 }
 
 func (db *Db) Size() (int64, error) {
@@ -1,6 +1,8 @@
 package datastore
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -176,7 +178,7 @@ func TestCompact(t *testing.T) {
 
 	key := "k"
 	value := "v"
-	recordSize := recordHeaderSize + len(key) + len(value)
+	recordSize := recordHeaderSize + seqSize + len(key) + len(value)
 	db, err := open(dir, int64(recordSize), defaultCompactionThreshold)
 	if err != nil {
 		t.Fatalf("Failed to open db: %v", err)
@@ -214,6 +216,243 @@ func TestCompact(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	key := "k"
+	value := "v"
+
+	func() {
+		db, err := Open(dir)
+		if err != nil {
+			t.Fatalf("Failed to open db: %v", err)
+		}
+		defer db.Close()
+
+		if err := db.Put(key, value); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if err := db.Delete(key); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound deleting missing key, got %v", err)
+		}
+	}()
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get(key); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after reopen, got %v", err)
+	}
+}
+
+func TestCompactDropsTombstones(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("deleted", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("kept", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	db.mu.Lock()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	segIndex, err := getIndexFromPath(db.segments[0].name)
+	if err != nil {
+		t.Fatalf("Failed to read compacted segment: %v", err)
+	}
+	if _, ok := segIndex["deleted"]; ok {
+		t.Errorf("Expected tombstone to be dropped by compaction")
+	}
+	if _, ok := segIndex["kept"]; !ok {
+		t.Errorf("Expected live key to survive compaction")
+	}
+	if _, err := db.Get("deleted"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after compaction, got %v", err)
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	if err := db.PutWithTTL("short", "v", 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to put with ttl: %v", err)
+	}
+	if err := db.PutInt64WithTTL("long", 7, time.Hour); err != nil {
+		t.Fatalf("Failed to put with ttl: %v", err)
+	}
+	if err := db.PutWithTTL("invalid", "v", 0); err == nil {
+		t.Errorf("Expected an error for a zero ttl")
+	}
+
+	if value, err := db.Get("short"); err != nil || value != "v" {
+		t.Errorf("Expected v before expiry, got %q, %v", value, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := db.Get("short"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after expiry, got %v", err)
+	}
+	if err := db.Delete("short"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deleting an expired key, got %v", err)
+	}
+	if keys := db.Keys(""); len(keys) != 1 || keys[0] != "long" {
+		t.Errorf("Expected only long to be listed, got %v", keys)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Get("short"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after reopen, got %v", err)
+	}
+	if value, err := db.GetInt64("long"); err != nil || value != 7 {
+		t.Errorf("Expected 7 after reopen, got %d, %v", value, err)
+	}
+}
+
+func TestCompactDropsExpired(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL("expired", "v", time.Millisecond); err != nil {
+		t.Fatalf("Failed to put with ttl: %v", err)
+	}
+	if err := db.PutWithTTL("alive", "v", time.Hour); err != nil {
+		t.Fatalf("Failed to put with ttl: %v", err)
+	}
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	segIndex, err := getIndexFromPath(db.segments[0].name)
+	if err != nil {
+		t.Fatalf("Failed to read compacted segment: %v", err)
+	}
+	if _, ok := segIndex["expired"]; ok {
+		t.Errorf("Expected expired record to be dropped by compaction")
+	}
+	if pos, ok := segIndex["alive"]; !ok || pos.expiresAt == 0 {
+		t.Errorf("Expected live record to keep its expiry, got %+v", pos)
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.PutBytes("bytes", []byte("raw")); err != nil {
+		t.Fatalf("Failed to put bytes: %v", err)
+	}
+	if err := db.PutFloat64("float", 0.25); err != nil {
+		t.Fatalf("Failed to put float64: %v", err)
+	}
+	if err := db.PutBool("bool", true); err != nil {
+		t.Fatalf("Failed to put bool: %v", err)
+	}
+	if err := db.PutJSON("json", json.RawMessage(`[1,"two"]`)); err != nil {
+		t.Fatalf("Failed to put json: %v", err)
+	}
+	if err := db.PutJSON("invalid", json.RawMessage(`[1,`)); err == nil {
+		t.Errorf("Expected an error for invalid JSON")
+	}
+
+	if v, err := db.GetBytes("bytes"); err != nil || string(v) != "raw" {
+		t.Errorf("GetBytes() = %q, %v", v, err)
+	}
+	if v, err := db.GetFloat64("float"); err != nil || v != 0.25 {
+		t.Errorf("GetFloat64() = %v, %v", v, err)
+	}
+	if v, err := db.GetBool("bool"); err != nil || !v {
+		t.Errorf("GetBool() = %v, %v", v, err)
+	}
+	if v, err := db.GetJSON("json"); err != nil || string(v) != `[1,"two"]` {
+		t.Errorf("GetJSON() = %s, %v", v, err)
+	}
+	if v, err := db.GetValue("float"); err != nil || v != 0.25 {
+		t.Errorf("GetValue() = %v, %v", v, err)
+	}
+
+	if _, err := db.Get("float"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected ErrTypeMismatch reading a float64 as string, got %v", err)
+	}
+	if _, err := db.GetInt64("float"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected ErrTypeMismatch reading a float64 as int64, got %v", err)
+	}
+	if _, err := db.GetBytes("json"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected ErrTypeMismatch reading json as bytes, got %v", err)
+	}
+	if err := db.PutValue("bad", struct{}{}); err == nil {
+		t.Errorf("Expected an error for an unsupported value type")
+	}
+}
+
 func TestSize(t *testing.T) {
 	dir := createTempDir(t)
 	defer os.RemoveAll(dir)
@@ -279,7 +518,7 @@ func TestMultipleKeys(t *testing.T) {
 	}
 }
 
-func createTempDir(t *testing.T) string {
+func createTempDir(t testing.TB) string {
 	dir := filepath.Join(os.TempDir(), "db-test-"+string(rune(time.Now().UnixNano())))
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
@@ -4,29 +4,112 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"time"
 )
 
 // Entry layout:
-// Header                                       Data
-// recordLen    dataType    keyLen    valLen    key    val
+// Header                                                             Data
+// recordLen    dataType    keyLen    valLen    flags    checksum    key    val
 // Offsets:
-// 0            4           5         9         13     13 + keyLen
+// 0            4           5         9         13       14          18     18 + keyLen
+//
+// The checksum is a CRC-32C of the whole record with the checksum field
+// itself left out. Records written before checksums were introduced have
+// neither flags nor checksum: their dataType has the dataTypeChecksummed
+// bit cleared and key follows the header at offset 13.
+//
+// Optional fields sit between the checksum and the key, in the order of the
+// flags announcing them:
+// expiresAt    int64 Unix time in nanoseconds after which the record is gone
+// seq          uint64 sequence number of the write, increasing across the
+//              whole database
+//
+// Flags:
+// flagBatch       the record belongs to a batch and takes effect only if
+//                 the batch commit marker follows it
+// flagExpires     the expiresAt field is present
+// flagSeq         the seq field is present; records written before
+//                 sequence numbers were introduced have none and count as
+//                 seq 0
+// flagCompressed  val is DEFLATE compressed and valLen is its compressed
+//                 size
 
 type DataType uint8
 
 const (
-	DataTypeString DataType = 1
-	DataTypeInt64  DataType = 2
+	DataTypeString    DataType = 1
+	DataTypeInt64     DataType = 2
+	DataTypeTombstone DataType = 3
+
+	// dataTypeBatchCommit marks the end of a batch. Its value is the
+	// number of records in the batch.
+	dataTypeBatchCommit DataType = 4
+
+	DataTypeBytes   DataType = 5
+	DataTypeFloat64 DataType = 6
+	DataTypeBool    DataType = 7
+	// DataTypeJSON holds a JSON document, kept byte for byte as written.
+	DataTypeJSON DataType = 8
+
+	// dataTypeSequence carries no key or value, only a seq. Compaction
+	// ends its output with one so that the highest sequence number handed
+	// out survives even when the record holding it is dropped.
+	dataTypeSequence DataType = 9
+
+	dataTypeChecksummed DataType = 0x80
 )
 
+func (dt DataType) String() string {
+	switch dt {
+	case DataTypeString:
+		return "string"
+	case DataTypeInt64:
+		return "int64"
+	case DataTypeTombstone:
+		return "tombstone"
+	case dataTypeBatchCommit:
+		return "batch commit"
+	case dataTypeSequence:
+		return "sequence"
+	case DataTypeBytes:
+		return "bytes"
+	case DataTypeFloat64:
+		return "float64"
+	case DataTypeBool:
+		return "bool"
+	case DataTypeJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("DataType(%d)", uint8(dt))
+	}
+}
+
+const (
+	flagBatch      uint8 = 1 << 0
+	flagExpires    uint8 = 1 << 1
+	flagSeq        uint8 = 1 << 2
+	flagCompressed uint8 = 1 << 3
+
+	knownFlags = flagBatch | flagExpires | flagSeq | flagCompressed
+)
+
+var ErrChecksum = fmt.Errorf("record checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type recordHeader struct {
 	RecordLen uint32
 	DataType  DataType
 	KeyLen    uint32
 	ValLen    uint32
+	Flags     uint8
+	Checksum  uint32
 }
 
 const (
@@ -34,13 +117,40 @@ const (
 	dataTypeSize     = 1
 	keyLenSize       = 4
 	valLenSize       = 4
-	recordHeaderSize = recordLenSize + dataTypeSize + keyLenSize + valLenSize
+	flagsSize        = 1
+	checksumSize     = 4
+	expiresAtSize    = 8
+	seqSize          = 8
+	legacyHeaderSize = recordLenSize + dataTypeSize + keyLenSize + valLenSize
+	checksumOffset   = legacyHeaderSize + flagsSize
+	recordHeaderSize = checksumOffset + checksumSize
 )
 
 type record struct {
 	key      string
 	value    any
 	dataType DataType
+	flags    uint8
+	// expiresAt is the Unix time in nanoseconds the record expires at, or
+	// zero if it never does.
+	expiresAt int64
+	// seq is the sequence number of the write, zero if it has none.
+	seq uint64
+	// compressThreshold makes Encode compress values of at least this many
+	// bytes when that makes them smaller. Zero never compresses.
+	compressThreshold int
+}
+
+// optionalFieldsSize returns the size of the optional fields flags announce.
+func optionalFieldsSize(flags uint8) int {
+	size := 0
+	if flags&flagExpires != 0 {
+		size += expiresAtSize
+	}
+	if flags&flagSeq != 0 {
+		size += seqSize
+	}
+	return size
 }
 
 func (r *record) Encode() ([]byte, error) {
@@ -48,21 +158,50 @@ func (r *record) Encode() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	flags := r.flags &^ (flagExpires | flagSeq | flagCompressed)
+	if r.compressThreshold > 0 && len(vb) >= r.compressThreshold {
+		compressed, err := compressValue(vb)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(vb) {
+			vb = compressed
+			flags |= flagCompressed
+		}
+	}
+	if r.expiresAt != 0 {
+		flags |= flagExpires
+	}
+	if r.seq != 0 {
+		flags |= flagSeq
+	}
+
 	kb := []byte(r.key)
 	kl, vl := uint32(len(kb)), uint32(len(vb))
-	rl := recordHeaderSize + vl + kl
+	rl := recordHeaderSize + uint32(optionalFieldsSize(flags)) + vl + kl
 
 	header := recordHeader{
 		RecordLen: rl,
-		DataType:  r.dataType,
+		DataType:  r.dataType | dataTypeChecksummed,
 		KeyLen:    kl,
 		ValLen:    vl,
+		Flags:     flags,
 	}
 
 	buf := &bytes.Buffer{}
 	if err := binary.Write(buf, binary.LittleEndian, header); err != nil {
 		return nil, err
 	}
+	if flags&flagExpires != 0 {
+		if err := binary.Write(buf, binary.LittleEndian, r.expiresAt); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagSeq != 0 {
+		if err := binary.Write(buf, binary.LittleEndian, r.seq); err != nil {
+			return nil, err
+		}
+	}
 	if _, err := buf.Write(kb); err != nil {
 		return nil, err
 	}
@@ -70,7 +209,15 @@ func (r *record) Encode() ([]byte, error) {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[checksumOffset:], recordChecksum(data))
+
+	return data, nil
+}
+
+func recordChecksum(data []byte) uint32 {
+	crc := crc32.Update(0, crcTable, data[:checksumOffset])
+	return crc32.Update(crc, crcTable, data[recordHeaderSize:])
 }
 
 func (r *record) encodeValue() ([]byte, error) {
@@ -90,6 +237,20 @@ func (dt DataType) getEncodeFunc(r *record) (func() ([]byte, error), error) {
 		return r.encodeString, nil
 	case DataTypeInt64:
 		return r.encodeInt64, nil
+	case DataTypeTombstone:
+		return r.encodeTombstone, nil
+	case dataTypeBatchCommit:
+		return r.encodeInt64, nil
+	case dataTypeSequence:
+		return r.encodeTombstone, nil
+	case DataTypeBytes:
+		return r.encodeBytes, nil
+	case DataTypeFloat64:
+		return r.encodeFloat64, nil
+	case DataTypeBool:
+		return r.encodeBool, nil
+	case DataTypeJSON:
+		return r.encodeJSON, nil
 	default:
 		return nil, fmt.Errorf("unknown datatype: %v", dt)
 	}
@@ -113,34 +274,123 @@ func (r *record) encodeInt64() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+func (r *record) encodeBytes() ([]byte, error) {
+	b, ok := r.value.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invalid value type: expected []byte")
+	}
+	return b, nil
+}
+
+func (r *record) encodeFloat64() ([]byte, error) {
+	v, ok := r.value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("invalid value type: expected float64")
+	}
+	return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)), nil
+}
+
+func (r *record) encodeBool() ([]byte, error) {
+	v, ok := r.value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("invalid value type: expected bool")
+	}
+	if v {
+		return []byte{1}, nil
+	}
+	return []byte{0}, nil
+}
+
+func (r *record) encodeJSON() ([]byte, error) {
+	v, ok := r.value.(json.RawMessage)
+	if !ok {
+		return nil, fmt.Errorf("invalid value type: expected json.RawMessage")
+	}
+	if !json.Valid(v) {
+		return nil, fmt.Errorf("invalid value: not a JSON document")
+	}
+	return v, nil
+}
+
+func (r *record) encodeTombstone() ([]byte, error) {
+	if r.value != nil {
+		return nil, fmt.Errorf("invalid value type: tombstone carries no value")
+	}
+	return nil, nil
+}
+
 func (r *record) Decode(input []byte) error {
-	if len(input) < recordHeaderSize {
-		return fmt.Errorf("input too short for header: got %d, expected %d", len(input), recordHeaderSize)
+	if len(input) < legacyHeaderSize {
+		return fmt.Errorf("input too short for header: got %d, expected %d", len(input), legacyHeaderSize)
 	}
 
-	buf := bytes.NewReader(input[:recordHeaderSize])
 	var header recordHeader
-	if err := binary.Read(buf, binary.LittleEndian, &header); err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
+	header.RecordLen = binary.LittleEndian.Uint32(input[0:])
+	header.DataType = DataType(input[recordLenSize])
+	header.KeyLen = binary.LittleEndian.Uint32(input[recordLenSize+dataTypeSize:])
+	header.ValLen = binary.LittleEndian.Uint32(input[recordLenSize+dataTypeSize+keyLenSize:])
+
+	headerSize := legacyHeaderSize
+	checksummed := header.DataType&dataTypeChecksummed != 0
+	if checksummed {
+		if len(input) < recordHeaderSize {
+			return fmt.Errorf("input too short for header: got %d, expected %d", len(input), recordHeaderSize)
+		}
+		header.Flags = input[legacyHeaderSize]
+		header.Checksum = binary.LittleEndian.Uint32(input[checksumOffset:])
+		headerSize = recordHeaderSize
 	}
 
-	r.dataType = header.DataType
+	r.dataType = header.DataType &^ dataTypeChecksummed
+
+	// The checksum is verified before the flags are trusted to tell which
+	// optional fields follow the header.
+	if checksummed {
+		if len(input) < int(header.RecordLen) {
+			return fmt.Errorf("input length mismatch: got %d, expected %d", len(input), header.RecordLen)
+		}
+		if int(header.RecordLen) < recordHeaderSize || recordChecksum(input[:header.RecordLen]) != header.Checksum {
+			return ErrChecksum
+		}
+		if header.Flags&^knownFlags != 0 {
+			return fmt.Errorf("unsupported record flags: %#x", header.Flags)
+		}
+	}
+	optionalSize := optionalFieldsSize(header.Flags)
 
-	expectedLen := recordHeaderSize + int(header.KeyLen) + int(header.ValLen)
+	expectedLen := headerSize + optionalSize + int(header.KeyLen) + int(header.ValLen)
 	if len(input) < expectedLen {
 		return fmt.Errorf("input length mismatch: got %d, expected %d", len(input), expectedLen)
 	}
 	if int(header.RecordLen) != expectedLen {
 		return fmt.Errorf("record length mismatch: recordLen says %d, expected %d", header.RecordLen, expectedLen)
 	}
+	r.flags = header.Flags
+
+	optional := input[headerSize:]
+	r.expiresAt = 0
+	if header.Flags&flagExpires != 0 {
+		r.expiresAt = int64(binary.LittleEndian.Uint64(optional))
+		optional = optional[expiresAtSize:]
+	}
+	r.seq = 0
+	if header.Flags&flagSeq != 0 {
+		r.seq = binary.LittleEndian.Uint64(optional)
+	}
 
-	keyStart := recordHeaderSize
+	keyStart := headerSize + optionalSize
 	keyEnd := keyStart + int(header.KeyLen)
 	r.key = string(input[keyStart:keyEnd])
 
 	valueStart := keyEnd
 	valueEnd := valueStart + int(header.ValLen)
 	valueBytes := input[valueStart:valueEnd]
+	if header.Flags&flagCompressed != 0 {
+		var err error
+		if valueBytes, err = decompressValue(valueBytes); err != nil {
+			return fmt.Errorf("cannot decompress value: %w", err)
+		}
+	}
 
 	return r.decodeValue(valueBytes)
 }
@@ -162,6 +412,20 @@ func (dt DataType) getDecodeFunc(r *record) (func([]byte) error, error) {
 		return r.decodeString, nil
 	case DataTypeInt64:
 		return r.decodeInt64, nil
+	case DataTypeTombstone:
+		return r.decodeTombstone, nil
+	case dataTypeBatchCommit:
+		return r.decodeInt64, nil
+	case dataTypeSequence:
+		return r.decodeTombstone, nil
+	case DataTypeBytes:
+		return r.decodeBytes, nil
+	case DataTypeFloat64:
+		return r.decodeFloat64, nil
+	case DataTypeBool:
+		return r.decodeBool, nil
+	case DataTypeJSON:
+		return r.decodeJSON, nil
 	default:
 		return nil, fmt.Errorf("unknown datatype: %v", dt)
 	}
@@ -180,27 +444,83 @@ func (r *record) decodeInt64(valueBytes []byte) error {
 	return nil
 }
 
+// Decoded values must not alias valueBytes: it may point into a memory
+// mapped segment that gets unmapped once the segment is compacted away.
+
+func (r *record) decodeBytes(valueBytes []byte) error {
+	value := make([]byte, len(valueBytes))
+	copy(value, valueBytes)
+	r.value = value
+	return nil
+}
+
+func (r *record) decodeFloat64(valueBytes []byte) error {
+	if len(valueBytes) != 8 {
+		return fmt.Errorf("invalid float64 value length: expected 8, got %d", len(valueBytes))
+	}
+	r.value = math.Float64frombits(binary.LittleEndian.Uint64(valueBytes))
+	return nil
+}
+
+func (r *record) decodeBool(valueBytes []byte) error {
+	if len(valueBytes) != 1 || valueBytes[0] > 1 {
+		return fmt.Errorf("invalid bool value: %v", valueBytes)
+	}
+	r.value = valueBytes[0] == 1
+	return nil
+}
+
+func (r *record) decodeJSON(valueBytes []byte) error {
+	value := make(json.RawMessage, len(valueBytes))
+	copy(value, valueBytes)
+	r.value = value
+	return nil
+}
+
+func (r *record) decodeTombstone(valueBytes []byte) error {
+	if len(valueBytes) != 0 {
+		return fmt.Errorf("invalid tombstone value length: expected 0, got %d", len(valueBytes))
+	}
+	r.value = nil
+	return nil
+}
+
+// DecodeFromReader reads one record from in. A record cut short by the end
+// of input is reported as io.ErrUnexpectedEOF together with the number of
+// bytes consumed; a clean end of input yields io.EOF and zero bytes.
 func (r *record) DecodeFromReader(in *bufio.Reader) (int, error) {
 	lenBuf, err := in.Peek(recordLenSize)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
+			if len(lenBuf) != 0 {
+				return 0, fmt.Errorf("DecodeFromReader: cannot read recordLen: %w", io.ErrUnexpectedEOF)
+			}
 			return 0, err
 		}
 		return 0, fmt.Errorf("DecodeFromReader: cannot read recordLen: %w", err)
 	}
 
 	recordLen := binary.LittleEndian.Uint32(lenBuf)
-	buf := make([]byte, recordLen)
-	n, err := in.Read(buf)
+	if recordLen < legacyHeaderSize {
+		return 0, fmt.Errorf("DecodeFromReader: invalid recordLen %d", recordLen)
+	}
+
+	// Copy instead of allocating recordLen upfront: a damaged length must not
+	// make us allocate more than the input actually holds.
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, in, int64(recordLen))
 	if err != nil {
-		return n, fmt.Errorf("DecodeFromReader: cannot read record: %w", err)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return int(n), fmt.Errorf("DecodeFromReader: cannot read record: %w", err)
 	}
 
-	if err := r.Decode(buf); err != nil {
-		return n, fmt.Errorf("DecodeFromReader: decode error: %w", err)
+	if err := r.Decode(buf.Bytes()); err != nil {
+		return int(n), fmt.Errorf("DecodeFromReader: decode error: %w", err)
 	}
 
-	return n, nil
+	return int(n), nil
 }
 
 func NewStringRecord(key, value string) *record {
@@ -218,3 +538,72 @@ func NewInt64Record(key string, value int64) *record {
 		dataType: DataTypeInt64,
 	}
 }
+
+func NewBytesRecord(key string, value []byte) *record {
+	return &record{
+		key:      key,
+		value:    value,
+		dataType: DataTypeBytes,
+	}
+}
+
+func NewFloat64Record(key string, value float64) *record {
+	return &record{
+		key:      key,
+		value:    value,
+		dataType: DataTypeFloat64,
+	}
+}
+
+func NewBoolRecord(key string, value bool) *record {
+	return &record{
+		key:      key,
+		value:    value,
+		dataType: DataTypeBool,
+	}
+}
+
+func NewJSONRecord(key string, value json.RawMessage) *record {
+	return &record{
+		key:      key,
+		value:    value,
+		dataType: DataTypeJSON,
+	}
+}
+
+// newValueRecord picks the data type of the record from the Go type of
+// value, the way the typed getters hand values back.
+func newValueRecord(key string, value any) (*record, error) {
+	switch v := value.(type) {
+	case string:
+		return NewStringRecord(key, v), nil
+	case int64:
+		return NewInt64Record(key, v), nil
+	case []byte:
+		return NewBytesRecord(key, v), nil
+	case float64:
+		return NewFloat64Record(key, v), nil
+	case bool:
+		return NewBoolRecord(key, v), nil
+	case json.RawMessage:
+		return NewJSONRecord(key, v), nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+// expireAfter makes the record expire ttl from now.
+func (r *record) expireAfter(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl %v: must be positive", ttl)
+	}
+	r.expiresAt = time.Now().Add(ttl).UnixNano()
+	return nil
+}
+
+func NewTombstoneRecord(key string) *record {
+	return &record{
+		key:      key,
+		dataType: DataTypeTombstone,
+	}
+}
@@ -1,8 +1,13 @@
 package datastore
 
 import (
+	"encoding/json"
+	"reflect"
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"testing"
 )
 
@@ -124,6 +129,39 @@ func TestRecord_DataTypes(t *testing.T) {
 			t.Errorf("Expected int64 value 42, got %d", val)
 		}
 	})
+	t.Run("bytes, float64, bool and json records", func(t *testing.T) {
+		records := []*record{
+			NewBytesRecord("bytes", []byte{0, 1, 0xff}),
+			NewBytesRecord("empty", []byte{}),
+			NewFloat64Record("float", -2.5),
+			NewBoolRecord("bool", true),
+			NewJSONRecord("json", json.RawMessage(`{"a":[1,2]}`)),
+		}
+		for _, r := range records {
+			encoded, err := r.Encode()
+			if err != nil {
+				t.Fatalf("%s: %v", r.key, err)
+			}
+
+			var decoded record
+			if err := decoded.Decode(encoded); err != nil {
+				t.Fatalf("%s: %v", r.key, err)
+			}
+			if decoded.dataType != r.dataType {
+				t.Errorf("%s: expected dataType %v, got %v", r.key, r.dataType, decoded.dataType)
+			}
+			if !reflect.DeepEqual(decoded.value, r.value) {
+				t.Errorf("%s: expected value %#v, got %#v", r.key, r.value, decoded.value)
+			}
+		}
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		r := NewJSONRecord("json", json.RawMessage(`{"a":`))
+		if _, err := r.Encode(); err == nil {
+			t.Error("Expected an error for an invalid JSON document")
+		}
+	})
 }
 
 func TestRecord_HelperConstructors(t *testing.T) {
@@ -185,6 +223,25 @@ func TestRecord_HelperConstructors(t *testing.T) {
 		}
 	})
 
+	t.Run("NewTombstoneRecord", func(t *testing.T) {
+		r := NewTombstoneRecord("gone")
+
+		encoded, err := r.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded record
+		err = decoded.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.key != "gone" || decoded.value != nil || decoded.dataType != DataTypeTombstone {
+			t.Errorf("NewTombstoneRecord encode/decode failed: %+v", decoded)
+		}
+	})
+
 	t.Run("NewInt64Record with negative value", func(t *testing.T) {
 		r := NewInt64Record("temperature", -10)
 
@@ -317,6 +374,105 @@ func TestRecord_BackwardCompatibility(t *testing.T) {
 	})
 }
 
+func TestRecord_Checksum(t *testing.T) {
+	t.Run("corrupted value", func(t *testing.T) {
+		r := NewStringRecord("key", "value")
+		encoded, err := r.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded[len(encoded)-1] ^= 0xff
+
+		var decoded record
+		if err := decoded.Decode(encoded); !errors.Is(err, ErrChecksum) {
+			t.Errorf("Expected ErrChecksum, got %v", err)
+		}
+		_, err = decoded.DecodeFromReader(bufio.NewReader(bytes.NewReader(encoded)))
+		if !errors.Is(err, ErrChecksum) {
+			t.Errorf("Expected ErrChecksum from DecodeFromReader, got %v", err)
+		}
+	})
+
+	t.Run("record with expiry", func(t *testing.T) {
+		r := NewInt64Record("key", 42)
+		r.expiresAt = 1700000000000000000
+		encoded, err := r.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) != recordHeaderSize+expiresAtSize+len("key")+8 {
+			t.Errorf("Unexpected encoded length %d", len(encoded))
+		}
+
+		var decoded record
+		if err := decoded.Decode(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.key != "key" || decoded.value != int64(42) || decoded.expiresAt != r.expiresAt {
+			t.Errorf("Decode mismatch: %+v", decoded)
+		}
+
+		encoded[recordHeaderSize] ^= 0xff
+		if err := decoded.Decode(encoded); !errors.Is(err, ErrChecksum) {
+			t.Errorf("Expected ErrChecksum for corrupted expiry, got %v", err)
+		}
+	})
+
+	t.Run("legacy record without checksum", func(t *testing.T) {
+		encoded := encodeLegacyRecord(t, "old", "format")
+
+		var decoded record
+		if err := decoded.Decode(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.key != "old" || decoded.value != "format" || decoded.dataType != DataTypeString {
+			t.Errorf("Legacy decode mismatch: %+v", decoded)
+		}
+	})
+
+	t.Run("truncated record", func(t *testing.T) {
+		r := NewStringRecord("key", "value")
+		encoded, err := r.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded record
+		n, err := decoded.DecodeFromReader(bufio.NewReader(bytes.NewReader(encoded[:len(encoded)-2])))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+		}
+		if n != len(encoded)-2 {
+			t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(encoded)-2)
+		}
+	})
+}
+
+// encodeLegacyRecord builds a string record in the layout used before
+// checksums were added to the header.
+func encodeLegacyRecord(t *testing.T, key, value string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	header := struct {
+		RecordLen uint32
+		DataType  DataType
+		KeyLen    uint32
+		ValLen    uint32
+	}{
+		RecordLen: uint32(legacyHeaderSize + len(key) + len(value)),
+		DataType:  DataTypeString,
+		KeyLen:    uint32(len(key)),
+		ValLen:    uint32(len(value)),
+	}
+	if err := binary.Write(buf, binary.LittleEndian, header); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(key)
+	buf.WriteString(value)
+	return buf.Bytes()
+}
+
 func TestRecord_ErrorHandling(t *testing.T) {
 	t.Run("encode with wrong type for string", func(t *testing.T) {
 		r := record{key: "test", value: int64(123), dataType: DataTypeString}
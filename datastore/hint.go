@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Hint file layout:
+// Header              Entries                                                         Footer
+// magic    maxSeq     keyLen    offset    size    flags    [expiresAt]    key    ...   segmentSize    checksum
+//
+// A hint file lists the last position of every key in one sealed segment,
+// so the index can be rebuilt without decoding the segment itself. maxSeq
+// is at least the highest sequence number written to the segment. The
+// footer records the size of the segment the hint was built from and a
+// CRC-32C of everything before the checksum; a hint that fails either check
+// is ignored in favour of a full scan. expiresAt is only present when the
+// hintFlagExpires flag is set.
+
+const (
+	hintPrefix = "hint-"
+	// hintMagic tells hint files carrying maxSeq from the ones written
+	// before; those are rebuilt from a scan.
+	hintMagic uint32 = 0x32746e68 // "hnt2"
+
+	hintFlagTombstone = 1 << 0
+	hintFlagExpires   = 1 << 1
+)
+
+type hintHeader struct {
+	Magic  uint32
+	MaxSeq uint64
+}
+
+type hintEntryHeader struct {
+	KeyLen uint32
+	Offset int64
+	Size   uint32
+	Flags  uint8
+}
+
+type hintFooter struct {
+	SegmentSize int64
+	Checksum    uint32
+}
+
+const (
+	hintHeaderSize      = 4 + 8
+	hintEntryHeaderSize = 4 + 8 + 4 + 1
+	hintFooterSize      = 8 + 4
+)
+
+func hintPath(segPath string) string {
+	ts := strings.TrimPrefix(filepath.Base(segPath), segmentPrefix)
+	return filepath.Join(filepath.Dir(segPath), hintPrefix+ts)
+}
+
+// writeHintFile stores the index of the segment at segPath together with
+// the segment size and maxSeq of scan. Hints are an optimisation: a failure
+// is only logged, and the next open scans the segment instead.
+func (db *Db) writeHintFile(segPath string, scan segmentScan) {
+	if err := writeHintFile(segPath, scan, db.opts.FileMode); err != nil {
+		db.logf("datastore: cannot write hint file for %s: %v", segPath, err)
+	}
+}
+
+// writeHintFile is written aside and renamed into place so that a crash
+// never leaves a partial hint behind.
+func writeHintFile(segPath string, scan segmentScan, perm os.FileMode) error {
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, hintHeader{hintMagic, scan.maxSeq}); err != nil {
+		return err
+	}
+	for key, pos := range scan.index {
+		header := hintEntryHeader{
+			KeyLen: uint32(len(key)),
+			Offset: pos.offset,
+			Size:   uint32(pos.size),
+		}
+		if pos.tombstone {
+			header.Flags |= hintFlagTombstone
+		}
+		if pos.expiresAt != 0 {
+			header.Flags |= hintFlagExpires
+		}
+		if err := binary.Write(buf, binary.LittleEndian, header); err != nil {
+			return err
+		}
+		if pos.expiresAt != 0 {
+			if err := binary.Write(buf, binary.LittleEndian, pos.expiresAt); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(key)
+	}
+	if err := binary.Write(buf, binary.LittleEndian, scan.end); err != nil {
+		return err
+	}
+	checksum := crc32.Checksum(buf.Bytes(), crcTable)
+	if err := binary.Write(buf, binary.LittleEndian, checksum); err != nil {
+		return err
+	}
+
+	path := hintPath(segPath)
+	tmpPath := path + ".tmp"
+	if err := writeFileSync(tmpPath, buf.Bytes(), perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readHintFile loads the index, size and maxSeq of the segment at segPath
+// from its hint file. It fails if the hint is missing, damaged, stale or in
+// an older format.
+func readHintFile(segPath string) (segmentScan, error) {
+	var scan segmentScan
+	data, err := os.ReadFile(hintPath(segPath))
+	if err != nil {
+		return scan, err
+	}
+	if len(data) < hintHeaderSize+hintFooterSize {
+		return scan, fmt.Errorf("hint file for %s is too short", segPath)
+	}
+
+	body := data[:len(data)-hintFooterSize]
+	var footer hintFooter
+	footer.SegmentSize = int64(binary.LittleEndian.Uint64(data[len(body):]))
+	footer.Checksum = binary.LittleEndian.Uint32(data[len(body)+8:])
+	if crc32.Checksum(data[:len(data)-4], crcTable) != footer.Checksum {
+		return scan, fmt.Errorf("hint file for %s: %w", segPath, ErrChecksum)
+	}
+	if binary.LittleEndian.Uint32(body) != hintMagic {
+		return scan, fmt.Errorf("hint file for %s has an outdated format", segPath)
+	}
+	scan.maxSeq = binary.LittleEndian.Uint64(body[4:])
+	body = body[hintHeaderSize:]
+
+	info, err := os.Stat(segPath)
+	if err != nil {
+		return scan, err
+	}
+	if info.Size() != footer.SegmentSize {
+		return scan, fmt.Errorf("hint file for %s is stale: segment size %d, hint built for %d",
+			segPath, info.Size(), footer.SegmentSize)
+	}
+
+	index := make(map[string]recordPosition)
+	seg := segment{segPath}
+	for len(body) > 0 {
+		if len(body) < hintEntryHeaderSize {
+			return scan, fmt.Errorf("hint file for %s has a truncated entry", segPath)
+		}
+		var header hintEntryHeader
+		header.KeyLen = binary.LittleEndian.Uint32(body[0:])
+		header.Offset = int64(binary.LittleEndian.Uint64(body[4:]))
+		header.Size = binary.LittleEndian.Uint32(body[12:])
+		header.Flags = body[16]
+		body = body[hintEntryHeaderSize:]
+
+		var expiresAt int64
+		if header.Flags&hintFlagExpires != 0 {
+			if len(body) < expiresAtSize {
+				return scan, fmt.Errorf("hint file for %s has a truncated entry", segPath)
+			}
+			expiresAt = int64(binary.LittleEndian.Uint64(body))
+			body = body[expiresAtSize:]
+		}
+
+		if uint32(len(body)) < header.KeyLen {
+			return scan, fmt.Errorf("hint file for %s has a truncated key", segPath)
+		}
+		key := string(body[:header.KeyLen])
+		body = body[header.KeyLen:]
+
+		index[key] = recordPosition{
+			segment:   seg,
+			offset:    header.Offset,
+			size:      int64(header.Size),
+			tombstone: header.Flags&hintFlagTombstone != 0,
+			expiresAt: expiresAt,
+		}
+	}
+
+	scan.index = index
+	scan.end = footer.SegmentSize
+	return scan, nil
+}
@@ -0,0 +1,154 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHintFileRoundTrip(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Delete("k1"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := db.PutWithTTL("k3", "v3", time.Hour); err != nil {
+		t.Fatalf("Failed to put with ttl: %v", err)
+	}
+
+	db.mu.Lock()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+
+	segPath := db.segments[0].name
+	hint, err := readHintFile(segPath)
+	if err != nil {
+		t.Fatalf("Failed to read hint file: %v", err)
+	}
+	scan, err := scanSegment(segPath, true)
+	if err != nil {
+		t.Fatalf("Failed to scan segment: %v", err)
+	}
+	fromHint := hint.index
+	if hint.maxSeq != scan.maxSeq || hint.end != scan.end {
+		t.Errorf("Expected maxSeq %d and size %d, got %d and %d", scan.maxSeq, scan.end, hint.maxSeq, hint.end)
+	}
+
+	if len(fromHint) != len(scan.index) {
+		t.Fatalf("Expected %d hint entries, got %d", len(scan.index), len(fromHint))
+	}
+	for key, pos := range scan.index {
+		if fromHint[key] != pos {
+			t.Errorf("Hint mismatch for %s: expected %+v, got %+v", key, pos, fromHint[key])
+		}
+	}
+	if !fromHint["k1"].tombstone {
+		t.Errorf("Expected hint to keep the tombstone for k1")
+	}
+	if fromHint["k3"].expiresAt == 0 {
+		t.Errorf("Expected hint to keep the expiry of k3")
+	}
+}
+
+func TestHintFileStale(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	db.mu.Lock()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+
+	segPath := db.segments[0].name
+	rec := NewStringRecord("k", "newer")
+	data, err := rec.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(t, segPath, data)
+
+	if _, err := readHintFile(segPath); err == nil {
+		t.Errorf("Expected a stale hint to be rejected")
+	}
+	index, err := getIndexFromPath(segPath)
+	if err != nil {
+		t.Fatalf("Failed to fall back to a full scan: %v", err)
+	}
+	if index["k"].offset == 0 {
+		t.Errorf("Expected the full scan to see the appended record")
+	}
+}
+
+func TestOpenPrefersHintFile(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	db.mu.Lock()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	segPath := db.segments[0].name
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	// Damage the value of k1 without changing the segment size: a full
+	// scan would reject the segment, the hint file lets Open skip it.
+	flipByte(t, segPath, int64(recordHeaderSize+seqSize+len("k1")+len("v1")-1))
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Expected Open to use the hint file, got: %v", err)
+	}
+	value, err := db.Get("k2")
+	if err != nil || value != "v2" {
+		t.Errorf("Expected v2 for k2, got %q, %v", value, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	if err := os.Remove(hintPath(segPath)); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(dir); err == nil {
+		db.Close()
+		t.Errorf("Expected Open without a hint file to scan and fail")
+	}
+}
@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// RecordInfo describes one record of a segment file as stored on disk.
+type RecordInfo struct {
+	Offset int64
+	// Size is the number of bytes the record takes in the file.
+	Size int64
+	// Err is set for a damaged record; the fields below are then unset.
+	Err error
+
+	Key  string
+	Type DataType
+	// Value is decompressed and decoded; it is nil for tombstones and
+	// sequence markers and the record count for batch commit markers.
+	Value      any
+	Seq        uint64
+	ExpiresAt  time.Time
+	Batch      bool
+	Compressed bool
+}
+
+// WalkSegment calls fn for every record of the segment file at path, in
+// file order, damaged records included. Walking goes on past a damaged
+// record whose length is intact and stops at the first one it cannot step
+// over. It stops early with the error fn returns, if any.
+func WalkSegment(path string, fn func(RecordInfo) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	in := bufio.NewReader(file)
+	var offset int64
+	for {
+		var rec record
+		n, err := rec.DecodeFromReader(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		info := RecordInfo{Offset: offset, Size: int64(n), Err: err}
+		if err == nil {
+			info.Key = rec.key
+			info.Type = rec.dataType
+			info.Value = rec.value
+			info.Seq = rec.seq
+			info.Batch = rec.flags&flagBatch != 0
+			info.Compressed = rec.flags&flagCompressed != 0
+			if rec.expiresAt != 0 {
+				info.ExpiresAt = time.Unix(0, rec.expiresAt)
+			}
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+
+		if err != nil && (n == 0 || errors.Is(err, io.ErrUnexpectedEOF)) {
+			return nil
+		}
+		offset += int64(n)
+	}
+}
+
+// RepairSegment rewrites the segment file at path keeping only the records
+// that decode cleanly and returns the damaged ones it dropped. Whatever
+// follows a record that cannot be stepped over is dropped with it. The
+// original file is kept next to the repaired one with a ".damaged" suffix,
+// which Open ignores. A segment without damage is left untouched.
+//
+// RepairSegment must not be used on a data directory a Db has open; LockDir
+// keeps one from opening it meanwhile.
+func RepairSegment(path string) ([]RecordError, error) {
+	var good []RecordInfo
+	var bad []RecordError
+	err := WalkSegment(path, func(info RecordInfo) error {
+		if info.Err != nil {
+			bad = append(bad, RecordError{Segment: path, Offset: info.Offset, Err: info.Err})
+		} else {
+			good = append(good, info)
+		}
+		return nil
+	})
+	if err != nil || len(bad) == 0 {
+		return nil, err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := path + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	keepTmp := false
+	defer func() {
+		if !keepTmp {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	for _, info := range good {
+		if _, err := io.Copy(dst, io.NewSectionReader(src, info.Offset, info.Size)); err != nil {
+			dst.Close()
+			return nil, err
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path, path+".damaged"); err != nil {
+		return nil, err
+	}
+	// The original is gone from path, so the copy is all there is now.
+	keepTmp = true
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, fmt.Errorf("repaired copy left at %s: %w", tmpPath, err)
+	}
+	// The hint describes the file as it was.
+	if err := os.Remove(hintPath(path)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return bad, nil
+}
+
+// LockDir takes the lock a writable Db holds on the data directory dir,
+// failing with ErrLocked while one has it open. Tools changing its files
+// directly hold the lock meanwhile; closing the result releases it.
+func LockDir(dir string) (io.Closer, error) {
+	return lockDir(dir, defaultFileMode)
+}
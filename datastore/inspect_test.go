@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestWalkSegment(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.PutInt64("k2", 2); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Delete("k1"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	segPath := db.currentSegment.Name()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	var infos []RecordInfo
+	if err := WalkSegment(segPath, func(info RecordInfo) error {
+		infos = append(infos, info)
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to walk segment: %v", err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(infos))
+	}
+	want := []struct {
+		key string
+		typ DataType
+	}{{"k1", DataTypeString}, {"k2", DataTypeInt64}, {"k1", DataTypeTombstone}}
+	var offset int64
+	for i, info := range infos {
+		if info.Err != nil || info.Key != want[i].key || info.Type != want[i].typ {
+			t.Errorf("Record %d: got %s %v, %v", i, info.Key, info.Type, info.Err)
+		}
+		if info.Offset != offset || info.Seq != uint64(i+1) {
+			t.Errorf("Record %d: expected offset %d and seq %d, got %d and %d", i, offset, i+1, info.Offset, info.Seq)
+		}
+		offset += info.Size
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = WalkSegment(segPath, func(RecordInfo) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Expected the walk to stop with fn's error, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRepairSegment(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	segPath := db.currentSegment.Name()
+	recSize := db.currentOffset / 3
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	if bad, err := RepairSegment(segPath); err != nil || bad != nil {
+		t.Fatalf("Expected an intact segment to be left alone, got %v, %v", bad, err)
+	}
+	if _, err := os.Stat(segPath + ".damaged"); !os.IsNotExist(err) {
+		t.Errorf("Expected no copy of an intact segment, got %v", err)
+	}
+
+	// Damage the value of k2 and tear the tail.
+	flipByte(t, segPath, 2*recSize-1)
+	rec := NewStringRecord("k4", "value")
+	data, err := rec.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(t, segPath, data[:len(data)/2])
+
+	bad, err := RepairSegment(segPath)
+	if err != nil {
+		t.Fatalf("Failed to repair segment: %v", err)
+	}
+	if len(bad) != 2 || bad[0].Offset != recSize || bad[1].Offset != 3*recSize {
+		t.Errorf("Expected records at %d and %d dropped, got %v", recSize, 3*recSize, bad)
+	}
+	if _, err := os.Stat(segPath + ".damaged"); err != nil {
+		t.Errorf("Expected the original segment to be kept: %v", err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open repaired db: %v", err)
+	}
+	defer db.Close()
+	for _, key := range []string{"k1", "k3"} {
+		if value, err := db.Get(key); err != nil || value != "value" {
+			t.Errorf("Expected %s to survive, got %q, %v", key, value, err)
+		}
+	}
+	if _, err := db.Get("k2"); err != ErrNotFound {
+		t.Errorf("Expected k2 to be dropped, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Iterator walks key/value pairs in ascending key order. It reads from a
+// snapshot of the index taken when it was created, so writes made later are
+// not visible to it. Close must be called to release the snapshot.
+type Iterator struct {
+	db        *Db
+	keys      []string
+	positions []recordPosition
+	next      int
+
+	key    string
+	value  any
+	err    error
+	closed bool
+}
+
+// NewIterator returns an iterator over keys in [start, end). An empty end
+// leaves the range unbounded.
+func (db *Db) NewIterator(start, end string) *Iterator {
+	type entry struct {
+		key string
+		pos recordPosition
+	}
+	var entries []entry
+
+	db.mu.RLock()
+	now := time.Now()
+	for key, pos := range db.index {
+		if key >= start && (end == "" || key < end) && !pos.expired(now) {
+			entries = append(entries, entry{key, pos})
+		}
+	}
+	db.pinSegmentsLocked()
+	db.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	it := &Iterator{
+		db:        db,
+		keys:      make([]string, len(entries)),
+		positions: make([]recordPosition, len(entries)),
+	}
+	for i, e := range entries {
+		it.keys[i] = e.key
+		it.positions[i] = e.pos
+	}
+	return it
+}
+
+// NewPrefixIterator returns an iterator over keys starting with prefix.
+func (db *Db) NewPrefixIterator(prefix string) *Iterator {
+	return db.NewIterator(prefix, prefixEnd(prefix))
+}
+
+// NewPrefixIteratorAfter returns an iterator over keys starting with prefix
+// that sort after key, as when resuming a listing that stopped at key. Only
+// those keys are copied and sorted.
+func (db *Db) NewPrefixIteratorAfter(prefix, key string) *Iterator {
+	start := prefix
+	if after := key + "\x00"; after > start {
+		start = after
+	}
+	return db.NewIterator(start, prefixEnd(prefix))
+}
+
+// Next advances to the next pair and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.closed || it.err != nil || it.next >= len(it.keys) {
+		return false
+	}
+
+	rec := &record{}
+	pos := it.positions[it.next]
+	if err := it.db.readRecord(rec, pos); err != nil {
+		it.err = err
+		return false
+	}
+
+	it.key = it.keys[it.next]
+	it.value = rec.value
+	it.next++
+	return true
+}
+
+// Seek moves the iterator so that the following Next yields the first key
+// not less than key.
+func (it *Iterator) Seek(key string) {
+	if i := sort.SearchStrings(it.keys, key); i > it.next {
+		it.next = i
+	}
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() any {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.db.unpinSegments()
+	return nil
+}
+
+// Keys returns the keys starting with prefix in ascending order.
+func (db *Db) Keys(prefix string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var keys []string
+	now := time.Now()
+	for key, pos := range db.index {
+		if strings.HasPrefix(key, prefix) && !pos.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Scan calls fn for every pair with a key in [start, end) in ascending key
+// order, stopping at the first error fn returns.
+func (db *Db) Scan(start, end string, fn func(key string, value any) error) error {
+	it := db.NewIterator(start, end)
+	defer it.Close()
+
+	for it.Next() {
+		if err := fn(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
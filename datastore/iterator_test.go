@@ -0,0 +1,227 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeys(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"user:2", "order:1", "user:1", "user:3"} {
+		if err := db.Put(key, "v"); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+	if err := db.Delete("user:3"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	keys := db.Keys("user:")
+	expected := []string{"user:1", "user:2"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+	if all := db.Keys(""); len(all) != 3 {
+		t.Errorf("Expected 3 keys, got %v", all)
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"d", "a", "c", "b", "e"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+	if err := db.PutInt64("bb", 42); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	var keys []string
+	var values []any
+	err = db.Scan("b", "d", func(key string, value any) error {
+		keys = append(keys, key)
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"b", "bb", "c"}) {
+		t.Errorf("Unexpected scanned keys: %v", keys)
+	}
+	if !reflect.DeepEqual(values, []any{"value-b", int64(42), "value-c"}) {
+		t.Errorf("Unexpected scanned values: %v", values)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = db.Scan("", "", func(key string, value any) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("Expected scan to stop on callback error, got %v after %d calls", err, count)
+	}
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := db.Put(key, "old"); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	it := db.NewPrefixIterator("k")
+
+	if err := db.Put("k2", "new"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("k4", "new"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	// Compaction retires the segment the iterator reads from.
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	oldSeg := db.currentSegment.Name()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+		if it.Value() != "old" {
+			t.Errorf("Expected snapshot value 'old' for %s, got %v", it.Key(), it.Value())
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"k1", "k2", "k3"}) {
+		t.Errorf("Unexpected iterated keys: %v", keys)
+	}
+
+	if _, err := os.Stat(oldSeg); err != nil {
+		t.Errorf("Expected retired segment to stay while the iterator is open: %v", err)
+	}
+	it.Close()
+	if _, err := os.Stat(oldSeg); !os.IsNotExist(err) {
+		t.Errorf("Expected retired segment to be removed after Close, got %v", err)
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, key); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	it := db.NewIterator("", "")
+	defer it.Close()
+
+	it.Seek("b\x00")
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if !reflect.DeepEqual(keys, []string{"c", "d"}) {
+		t.Errorf("Unexpected keys after seek: %v", keys)
+	}
+}
+
+func TestPrefixIteratorAfter(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "p/1", "p/2", "p/3", "q"} {
+		if err := db.Put(key, key); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	cases := []struct {
+		prefix, after string
+		expected      []string
+	}{
+		{"p/", "p/1", []string{"p/2", "p/3"}},
+		{"p/", "a", []string{"p/1", "p/2", "p/3"}},
+		{"p/", "p/3", nil},
+		{"", "p/2", []string{"p/3", "q"}},
+	}
+	for _, c := range cases {
+		it := db.NewPrefixIteratorAfter(c.prefix, c.after)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		it.Close()
+		if !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("NewPrefixIteratorAfter(%q, %q) yielded %v, expected %v", c.prefix, c.after, keys, c.expected)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"":         "",
+		"abc":      "abd",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	}
+	for prefix, expected := range cases {
+		if got := prefixEnd(prefix); got != expected {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", prefix, got, expected)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// valueTypes lists the data types values can be stored as.
+var valueTypes = []DataType{
+	DataTypeString, DataTypeInt64, DataTypeFloat64, DataTypeBool, DataTypeBytes, DataTypeJSON,
+}
+
+// ParseDataType returns the value type named name, as DataType.String
+// names it.
+func ParseDataType(name string) (DataType, error) {
+	for _, dt := range valueTypes {
+		if dt.String() == name {
+			return dt, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type %q", name)
+}
+
+// TypeOf returns the data type value is stored as by PutValue, or zero if
+// it cannot be stored.
+func TypeOf(value any) DataType {
+	switch value.(type) {
+	case string:
+		return DataTypeString
+	case int64:
+		return DataTypeInt64
+	case float64:
+		return DataTypeFloat64
+	case bool:
+		return DataTypeBool
+	case []byte:
+		return DataTypeBytes
+	case json.RawMessage:
+		return DataTypeJSON
+	default:
+		return 0
+	}
+}
+
+// ValueFromJSON converts a JSON value into a value of type dt for PutValue.
+// Bytes are expected base64 encoded, the way encoding/json writes them, so
+// values read back and marshalled round-trip. A zero dt picks the type from
+// the JSON itself: strings, integers, other numbers, booleans, and objects
+// or arrays become string, int64, float64, bool and JSON values.
+func ValueFromJSON(raw json.RawMessage, dt DataType) (any, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("value is required")
+	}
+
+	switch dt {
+	case 0:
+		return valueFromUntypedJSON(raw)
+	case DataTypeString:
+		var v string
+		return v, json.Unmarshal(raw, &v)
+	case DataTypeInt64:
+		var v int64
+		return v, json.Unmarshal(raw, &v)
+	case DataTypeFloat64:
+		var v float64
+		return v, json.Unmarshal(raw, &v)
+	case DataTypeBool:
+		var v bool
+		return v, json.Unmarshal(raw, &v)
+	case DataTypeBytes:
+		var v []byte
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		return v, nil
+	case DataTypeJSON:
+		if !json.Valid(raw) {
+			return nil, errors.New("not a JSON document")
+		}
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %v", dt)
+	}
+}
+
+func valueFromUntypedJSON(raw json.RawMessage) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// Numbers stay exact until we know whether they are integers.
+	decoder.UseNumber()
+
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case string, bool:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case map[string]any, []any:
+		return raw, nil
+	default:
+		return nil, errors.New("null values are not supported")
+	}
+}
@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValueFromJSON(t *testing.T) {
+	tests := []struct {
+		raw  string
+		dt   DataType
+		want any
+	}{
+		{`"text"`, 0, "text"},
+		{`42`, 0, int64(42)},
+		{`4.5`, 0, 4.5},
+		{`true`, 0, true},
+		{`{"a":1}`, 0, json.RawMessage(`{"a":1}`)},
+		{`3`, DataTypeFloat64, 3.0},
+		{`"aGk="`, DataTypeBytes, []byte("hi")},
+		{`"text"`, DataTypeJSON, json.RawMessage(`"text"`)},
+	}
+	for _, tt := range tests {
+		got, err := ValueFromJSON(json.RawMessage(tt.raw), tt.dt)
+		if err != nil {
+			t.Errorf("ValueFromJSON(%s, %v) failed: %v", tt.raw, tt.dt, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ValueFromJSON(%s, %v) = %#v, want %#v", tt.raw, tt.dt, got, tt.want)
+		}
+		if want := tt.dt; want != 0 && TypeOf(got) != want {
+			t.Errorf("TypeOf(%#v) = %v, want %v", got, TypeOf(got), want)
+		}
+	}
+
+	invalid := []struct {
+		raw string
+		dt  DataType
+	}{
+		{``, 0},
+		{`null`, 0},
+		{`"text"`, DataTypeInt64},
+		{`{"a":`, DataTypeJSON},
+	}
+	for _, tt := range invalid {
+		if _, err := ValueFromJSON(json.RawMessage(tt.raw), tt.dt); err == nil {
+			t.Errorf("Expected ValueFromJSON(%q, %v) to fail", tt.raw, tt.dt)
+		}
+	}
+}
+
+func TestParseDataType(t *testing.T) {
+	for _, dt := range valueTypes {
+		parsed, err := ParseDataType(dt.String())
+		if err != nil || parsed != dt {
+			t.Errorf("ParseDataType(%q) = %v, %v", dt.String(), parsed, err)
+		}
+	}
+	if _, err := ParseDataType("tombstone"); err == nil {
+		t.Errorf("Expected tombstone not to be a value type")
+	}
+}
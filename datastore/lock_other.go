@@ -0,0 +1,15 @@
+//go:build !unix
+
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir creates the lock file of dir. Without flock the lock is not
+// enforced: a file left behind by a crash would otherwise keep the
+// directory locked forever.
+func lockDir(dir string, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, perm)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package datastore
+
+import "errors"
+
+const mmapSupported = false
+
+func mmapFile(path string) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMMapSealedSegments(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{MaxSegmentSize: 1024, MMap: true})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	oldSeg := db.currentSegment.Name()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	if db.readers.mapping(oldSeg) == nil {
+		t.Fatalf("Expected the sealed segment to be mapped")
+	}
+	if db.readers.mapping(db.currentSegment.Name()) != nil {
+		t.Errorf("Expected the current segment not to be mapped")
+	}
+	for key, want := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if value, err := db.Get(key); err != nil || value != want {
+			t.Errorf("Expected %s for %s, got %q, %v", want, key, value, err)
+		}
+	}
+	if _, ok := db.readers.files[oldSeg]; ok {
+		t.Errorf("Expected the mapped segment to be read without a file handle")
+	}
+
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if db.readers.mapping(oldSeg) != nil {
+		t.Errorf("Expected the removed segment to be unmapped")
+	}
+	if value, err := db.Get("k1"); err != nil || value != "v1" {
+		t.Errorf("Expected v1 after compaction, got %q, %v", value, err)
+	}
+	if db.readers.mapping(db.segments[0].name) == nil {
+		t.Errorf("Expected the compacted segment to be mapped")
+	}
+}
+
+func BenchmarkGetMMap(b *testing.B) {
+	if !mmapSupported {
+		b.Skip("mmap is not supported on this platform")
+	}
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("MMap=%t", mmap), func(b *testing.B) {
+			dir := createTempDir(b)
+			defer os.RemoveAll(dir)
+
+			db, err := OpenWithOptions(dir, Options{Sync: SyncNone, MMap: mmap})
+			if err != nil {
+				b.Fatalf("Failed to open db: %v", err)
+			}
+			defer db.Close()
+
+			const keys = 1000
+			for i := 0; i < keys; i++ {
+				if err := db.Put(fmt.Sprintf("key-%d", i), "some moderately sized value"); err != nil {
+					b.Fatalf("Failed to put: %v", err)
+				}
+			}
+			db.mu.Lock()
+			if err := db.rotateSegmentLocked(); err != nil {
+				b.Fatalf("Failed to rotate segment: %v", err)
+			}
+			db.mu.Unlock()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("key-%d", i%keys)); err != nil {
+					b.Fatalf("Failed to get: %v", err)
+				}
+			}
+		})
+	}
+}
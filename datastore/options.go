@@ -0,0 +1,204 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// SyncMode selects when writes are flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs the segment before every write returns.
+	SyncAlways SyncMode = iota
+	// SyncGroup lets concurrent writers share one fsync. A write returns
+	// once an fsync issued after it completes. Writers arriving while an
+	// fsync runs are covered together by the next one.
+	SyncGroup
+	// SyncPeriodic fsyncs every SyncInterval in the background. Writes
+	// return immediately and up to one interval of them may be lost.
+	SyncPeriodic
+	// SyncNone leaves flushing to the operating system.
+	SyncNone
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncGroup:
+		return "group"
+	case SyncPeriodic:
+		return "periodic"
+	case SyncNone:
+		return "none"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+}
+
+// ParseSyncMode is the inverse of SyncMode.String.
+func ParseSyncMode(s string) (SyncMode, error) {
+	for _, m := range []SyncMode{SyncAlways, SyncGroup, SyncPeriodic, SyncNone} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync mode: %q", s)
+}
+
+const (
+	defaultGarbageRatio       = 0.5
+	defaultCompactionInterval = time.Minute
+	defaultMaxSyncBatch       = 128
+	defaultSyncInterval       = time.Second
+	defaultFileMode           = 0o600
+	defaultDirMode            = 0o755
+)
+
+// Options tune a Db opened with OpenWithOptions. Zero fields fall back to
+// the defaults used by Open.
+type Options struct {
+	// MaxSegmentSize is the size past which the current segment is sealed
+	// and a new one started.
+	MaxSegmentSize int64
+	// CompactionThreshold is the number of dirty sealed segments that
+	// triggers a compaction. Only the dirty segments are merged.
+	CompactionThreshold int
+	// GarbageRatio is the fraction of dead bytes from which a sealed
+	// segment counts as dirty: bytes of overwritten or deleted records,
+	// tombstones and other records the index no longer points at.
+	GarbageRatio float64
+	// CompactionWindows restrict automatic compaction to certain times of
+	// day. Inside a window every dirty segment is compacted, checked each
+	// CompactionInterval, even when no rotation triggers it. No windows
+	// means compaction may run at any time, triggered by rotation only.
+	CompactionWindows  []CompactionWindow
+	CompactionInterval time.Duration
+
+	// FileMode is the permission of created segment and hint files.
+	FileMode os.FileMode
+	// DirMode is the permission of the data directory if it is created.
+	DirMode os.FileMode
+
+	// ReadOnly opens an existing data directory without creating a
+	// segment; writes fail with ErrReadOnly. Unlike writers, any number of
+	// read-only Dbs may share a directory with one writer. Refresh picks
+	// up what the writer appended since.
+	ReadOnly bool
+	// RefreshInterval makes a read-only Db refresh itself periodically.
+	// Zero leaves refreshing to explicit Refresh calls.
+	RefreshInterval time.Duration
+
+	// Recover opens a data directory with damaged segments as OpenRecover
+	// does, logging what it worked around, instead of failing. It is
+	// ignored by read-only Dbs, which never change segment files.
+	Recover bool
+
+	// CompressionThreshold is the value size in bytes from which values
+	// are stored DEFLATE compressed, provided that makes them smaller.
+	// Zero disables compression. Compaction rewrites every record it keeps
+	// under the current threshold.
+	CompressionThreshold int
+
+	// MMap maps sealed segments into memory and serves reads from them.
+	// It is ignored on platforms without mmap support.
+	MMap bool
+
+	// Logger receives failures of background work such as compaction.
+	// Nil discards them.
+	Logger *log.Logger
+	// OnCompaction is called after every compaction run with its result,
+	// from the goroutine that ran it and before another run can start.
+	OnCompaction func(CompactionResult)
+
+	Sync SyncMode
+
+	// MaxSyncDelay lets SyncGroup hold an fsync back for up to this long to
+	// gather more writers. Zero syncs as soon as the previous fsync is done.
+	MaxSyncDelay time.Duration
+	// MaxSyncBatch cuts MaxSyncDelay short once this many writers wait.
+	MaxSyncBatch int
+	// SyncInterval is the fsync period of SyncPeriodic.
+	SyncInterval time.Duration
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if opts.CompactionThreshold <= 0 {
+		opts.CompactionThreshold = defaultCompactionThreshold
+	}
+	if opts.GarbageRatio <= 0 {
+		opts.GarbageRatio = defaultGarbageRatio
+	}
+	if opts.CompactionInterval <= 0 {
+		opts.CompactionInterval = defaultCompactionInterval
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = defaultFileMode
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = defaultDirMode
+	}
+	if !mmapSupported {
+		opts.MMap = false
+	}
+	if opts.MaxSyncBatch <= 0 {
+		opts.MaxSyncBatch = defaultMaxSyncBatch
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+	return opts
+}
+
+func OpenWithOptions(dir string, opts Options) (*Db, error) {
+	db, report, err := openWithOptions(dir, opts)
+	if report != nil {
+		db.logRecovery(report)
+	}
+	return db, err
+}
+
+func openWithOptions(dir string, opts Options) (*Db, *RecoveryReport, error) {
+	db, err := newDb(dir, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var report *RecoveryReport
+	if db.opts.Recover && !db.readOnly.Load() {
+		report, err = db.recoverIndexLocked()
+	} else if err = db.rebuildIndexLocked(); err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		db.unlock()
+		return nil, nil, err
+	}
+
+	db.mmapSealedSegmentsLocked()
+
+	if !db.readOnly.Load() {
+		if err := db.createCurrentSegmentLocked(); err != nil {
+			db.unlock()
+			return nil, nil, err
+		}
+	}
+	db.startSyncer()
+	db.startCompactionScheduler()
+	db.startRefresher()
+
+	return db, report, nil
+}
+
+func (db *Db) logf(format string, args ...any) {
+	if db.opts.Logger != nil {
+		db.opts.Logger.Printf(format, args...)
+	}
+}
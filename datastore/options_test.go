@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenWithOptionsSegmentSize(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{
+		MaxSegmentSize:      80,
+		CompactionThreshold: 100,
+		FileMode:            0o640,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := db.Put(key, "some value"); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+	// Two 38 byte records fit into 80 bytes, the third one seals them.
+	if len(db.segments) != 1 {
+		t.Errorf("Expected 1 sealed segment, got %d", len(db.segments))
+	}
+
+	info, err := os.Stat(db.currentSegment.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("Expected file mode 0640, got %v", info.Mode().Perm())
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	filesBefore, _ := filepath.Glob(filepath.Join(dir, "*"))
+
+	db, err = OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open db read-only: %v", err)
+	}
+	defer db.Close()
+
+	if value, err := db.Get("k"); err != nil || value != "v" {
+		t.Errorf("Expected v, got %q, %v", value, err)
+	}
+	if err := db.Put("k", "other"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly from Put, got %v", err)
+	}
+	if err := db.Delete("k"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly from Delete, got %v", err)
+	}
+
+	filesAfter, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(filesAfter) != len(filesBefore) {
+		t.Errorf("Expected read-only open to leave the directory alone: %v -> %v", filesBefore, filesAfter)
+	}
+
+	if _, err := OpenWithOptions(filepath.Join(dir, "missing"), Options{ReadOnly: true}); err == nil {
+		t.Errorf("Expected read-only open of a missing directory to fail")
+	}
+}
+
+func TestParseSyncMode(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncGroup, SyncPeriodic, SyncNone} {
+		parsed, err := ParseSyncMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Errorf("ParseSyncMode(%q) = %v, %v", mode.String(), parsed, err)
+		}
+	}
+	if _, err := ParseSyncMode("sometimes"); err == nil {
+		t.Errorf("Expected an error for an unknown sync mode")
+	}
+}
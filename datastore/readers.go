@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// segmentReaders keeps one read-only handle per segment file so that reads
+// do not open the file every time. Handles serve concurrent readers through
+// ReadAt and are closed once their segment is removed from disk.
+//
+// Sealed segments never change, so with Options.MMap they are also mapped
+// into memory and decoded from there without any syscall. Mappings are
+// unmapped together with the handles.
+type segmentReaders struct {
+	mu     sync.Mutex
+	files  map[string]*os.File
+	mapped map[string][]byte
+}
+
+func (r *segmentReaders) get(path string) (*os.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if file, ok := r.files[path]; ok {
+		return file, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if r.files == nil {
+		r.files = make(map[string]*os.File)
+	}
+	r.files[path] = file
+	return file, nil
+}
+
+// mapping returns the memory mapping of a sealed segment, if there is one.
+func (r *segmentReaders) mapping(path string) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mapped[path]
+}
+
+// mmap maps the sealed segment at path. It must only be called once the
+// segment will not be appended to anymore. A segment already mapped keeps
+// its mapping, which readers may still be using.
+func (r *segmentReaders) mmap(path string) error {
+	if r.mapping(path) != nil {
+		return nil
+	}
+	data, err := mmapFile(path)
+	if err != nil || data == nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mapped == nil {
+		r.mapped = make(map[string][]byte)
+	}
+	r.mapped[path] = data
+	return nil
+}
+
+// release closes the handle and mapping of a segment nobody can read
+// anymore.
+func (r *segmentReaders) release(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if file, ok := r.files[path]; ok {
+		file.Close()
+		delete(r.files, path)
+	}
+	if data, ok := r.mapped[path]; ok {
+		munmap(data)
+		delete(r.mapped, path)
+	}
+}
+
+func (r *segmentReaders) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for path, file := range r.files {
+		file.Close()
+		delete(r.files, path)
+	}
+	for path, data := range r.mapped {
+		munmap(data)
+		delete(r.mapped, path)
+	}
+}
+
+// readRecord decodes the record at pos. The caller must make sure the
+// segment stays on disk meanwhile, either by holding mu or a pin.
+func (db *Db) readRecord(rec *record, pos recordPosition) error {
+	if data := db.readers.mapping(pos.segment.name); int64(len(data)) >= pos.offset+pos.size {
+		return rec.Decode(data[pos.offset : pos.offset+pos.size])
+	}
+
+	file, err := db.readers.get(pos.segment.name)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, pos.size)
+	if _, err := file.ReadAt(buf, pos.offset); err != nil {
+		return fmt.Errorf("cannot read record at %s:%d: %w", pos.segment.name, pos.offset, err)
+	}
+	return rec.Decode(buf)
+}
+
+// mmapSegment maps a freshly sealed segment if Options.MMap asks for it.
+// Reads fall back to the file handle when mapping fails.
+func (db *Db) mmapSegment(path string) {
+	if !db.opts.MMap {
+		return
+	}
+	if err := db.readers.mmap(path); err != nil {
+		db.logf("datastore: cannot mmap %s: %v", path, err)
+	}
+}
+
+// mmapSealedSegmentsLocked maps the segments found on open. A read-only Db
+// leaves the newest one alone: another process may still be appending to it.
+func (db *Db) mmapSealedSegmentsLocked() {
+	segs := db.segments
+	if db.readOnly.Load() && len(segs) > 0 {
+		segs = segs[:len(segs)-1]
+	}
+	for _, seg := range segs {
+		db.mmapSegment(seg.name)
+	}
+}
@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSegmentReadersReuseHandles(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Get("k"); err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+	}
+	if len(db.readers.files) != 1 {
+		t.Errorf("Expected 1 pooled handle, got %d", len(db.readers.files))
+	}
+
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	oldSeg := db.currentSegment.Name()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	if _, ok := db.readers.files[oldSeg]; ok {
+		t.Errorf("Expected the handle of the removed segment to be released")
+	}
+	if value, err := db.Get("k"); err != nil || value != "v" {
+		t.Errorf("Expected v after compaction, got %q, %v", value, err)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	dir := createTempDir(b)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{Sync: SyncNone})
+	if err != nil {
+		b.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "some moderately sized value"); err != nil {
+			b.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	b.Run("PooledHandles", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(fmt.Sprintf("key-%d", i%keys)); err != nil {
+				b.Fatalf("Failed to get: %v", err)
+			}
+		}
+	})
+
+	// The read path used before handles were pooled: open, seek and wrap
+	// the segment in a fresh buffered reader on every lookup.
+	b.Run("OpenPerGet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db.mu.RLock()
+			pos := db.index[fmt.Sprintf("key-%d", i%keys)]
+			db.mu.RUnlock()
+
+			file, err := os.Open(pos.segment.name)
+			if err != nil {
+				b.Fatalf("Failed to open segment: %v", err)
+			}
+			if _, err := file.Seek(pos.offset, io.SeekStart); err != nil {
+				b.Fatalf("Failed to seek: %v", err)
+			}
+			var rec record
+			if _, err := rec.DecodeFromReader(bufio.NewReader(file)); err != nil {
+				b.Fatalf("Failed to decode: %v", err)
+			}
+			file.Close()
+		}
+	})
+}
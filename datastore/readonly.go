@@ -0,0 +1,183 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// ReadOnly reports whether the database refuses writes.
+func (db *Db) ReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// Refresh brings the index of a read-only Db up to date with the writer
+// sharing its directory: records appended to the newest segment since the
+// last refresh and segments that appeared meanwhile are added. When the
+// writer compacted away segments this Db knows about, the index is rebuilt
+// from the current set of segments. Refresh does nothing on a writable Db.
+func (db *Db) Refresh() error {
+	if !db.readOnly.Load() {
+		return nil
+	}
+	paths, err := SegmentFiles(db.dir)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Segments a follower dropped stay on disk while snapshots read them.
+	paths = slices.DeleteFunc(paths, func(path string) bool { return db.dropped[path] })
+	return db.refreshLocked(paths)
+}
+
+// refreshLocked brings the index up to date with the segment files at
+// paths. On failure the index keeps what it had or what was applied
+// completely, so that reads go on while the next refresh tries again.
+func (db *Db) refreshLocked(paths []string) error {
+	if !db.knowsPrefixLocked(paths) {
+		return db.reloadLocked(paths)
+	}
+	return db.appendSegmentsLocked(paths)
+}
+
+// appendSegmentsLocked applies the records appended to the newest known
+// segment and the segments of paths past the known ones. A segment is only
+// added once its records are merged.
+func (db *Db) appendSegmentsLocked(paths []string) error {
+	known := len(db.segments)
+	if known > 0 {
+		if err := db.tailLocked(); err != nil {
+			return err
+		}
+	}
+	for i, path := range paths[known:] {
+		seg := segment{path}
+		if known+i == len(paths)-1 {
+			// The writer may still be appending to the newest segment.
+			if err := db.tailSegmentLocked(seg, 0); err != nil {
+				return err
+			}
+			db.sealNewestLocked()
+			db.segments = append(db.segments, seg)
+			return nil
+		}
+
+		scan, err := db.loadSegment(path)
+		if err != nil {
+			return err
+		}
+		db.sealNewestLocked()
+		db.segments = append(db.segments, seg)
+		db.mergeScanLocked(seg, scan)
+	}
+	return nil
+}
+
+// sealNewestLocked maps the newest known segment once the writer has moved
+// on to a newer one.
+func (db *Db) sealNewestLocked() {
+	if len(db.segments) > 0 {
+		db.mmapSegment(db.segments[len(db.segments)-1].name)
+	}
+}
+
+// reloadLocked rebuilds the index from the segment files at paths, as
+// needed once the writer has compacted segments this Db knows about. The
+// index in place stays until the new one is complete; the segments missing
+// from paths are only retired then.
+func (db *Db) reloadLocked(paths []string) error {
+	segments, index, usage, tail := db.segments, db.index, db.usage, db.tail
+	db.segments = nil
+	db.tail = 0
+	db.resetIndexLocked()
+	if err := db.appendSegmentsLocked(paths); err != nil {
+		db.segments, db.index, db.usage, db.tail = segments, index, usage, tail
+		return err
+	}
+
+	var gone []segment
+	for _, seg := range segments {
+		if !slices.Contains(paths, seg.name) {
+			gone = append(gone, seg)
+		}
+	}
+	db.retireSegmentsLocked(gone)
+	return nil
+}
+
+// knowsPrefixLocked reports whether the segments of db are the oldest of
+// paths, which is the case as long as the writer has not compacted them.
+func (db *Db) knowsPrefixLocked(paths []string) bool {
+	if len(db.segments) > len(paths) {
+		return false
+	}
+	for i, seg := range db.segments {
+		if paths[i] != seg.name {
+			return false
+		}
+	}
+	return true
+}
+
+// tailLocked applies the records of the newest segment past db.tail. A
+// record still being written, or a batch still waiting for its commit
+// marker, is left for the next call.
+func (db *Db) tailLocked() error {
+	return db.tailSegmentLocked(db.segments[len(db.segments)-1], db.tail)
+}
+
+// tailSegmentLocked applies the records of seg past offset from and moves
+// db.tail past them.
+func (db *Db) tailSegmentLocked(seg segment, from int64) error {
+	scan, err := scanSegmentFrom(seg.name, from, false)
+	if err != nil {
+		return err
+	}
+	for i, bad := range scan.bad {
+		if i == len(scan.bad)-1 && errors.Is(bad.Err, io.ErrUnexpectedEOF) {
+			break
+		}
+		return fmt.Errorf("corrupted segment file %s: %w", seg.name, bad)
+	}
+
+	db.mergeIndexLocked(scan.index)
+	db.lastSeq = max(db.lastSeq, scan.maxSeq)
+	db.usageLocked(seg).size = scan.committed
+	db.tail = scan.committed
+	return nil
+}
+
+// startRefresher refreshes a read-only Db every Options.RefreshInterval.
+func (db *Db) startRefresher() {
+	db.refreshStop = make(chan struct{})
+	db.refreshDone = make(chan struct{})
+	if !db.readOnly.Load() || db.opts.RefreshInterval <= 0 {
+		close(db.refreshDone)
+		return
+	}
+
+	go func() {
+		defer close(db.refreshDone)
+		ticker := time.NewTicker(db.opts.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.Refresh(); err != nil {
+					db.logf("datastore: refresh failed: %v", err)
+				}
+			case <-db.refreshStop:
+				return
+			}
+		}
+	}()
+}
+
+func (db *Db) stopRefresher() {
+	close(db.refreshStop)
+	<-db.refreshDone
+}
@@ -0,0 +1,269 @@
+package datastore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if _, err := Open(dir); err != ErrLocked {
+		t.Fatalf("Expected ErrLocked from a second writer, got %v", err)
+	}
+
+	reader, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open db read-only next to the writer: %v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("Failed to close reader: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen db once the writer closed it: %v", err)
+	}
+	db.Close()
+}
+
+func TestRefresh(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{MaxSegmentSize: 100, CompactionThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	reader, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open db read-only: %v", err)
+	}
+	defer reader.Close()
+
+	expect := func(key, want string) {
+		t.Helper()
+		value, err := reader.Get(key)
+		if want == "" {
+			if err != ErrNotFound {
+				t.Errorf("Expected %s to be missing, got %q, %v", key, value, err)
+			}
+			return
+		}
+		if err != nil || value != want {
+			t.Errorf("Expected %s = %q, got %q, %v", key, want, value, err)
+		}
+	}
+	refresh := func() {
+		t.Helper()
+		if err := reader.Refresh(); err != nil {
+			t.Fatalf("Failed to refresh: %v", err)
+		}
+	}
+	expect("k1", "v1")
+
+	// Appends to the segment the reader already tails.
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Delete("k1"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	expect("k2", "")
+	refresh()
+	expect("k1", "")
+	expect("k2", "v2")
+
+	// Rotation into new segments.
+	for _, key := range []string{"k3", "k4", "k5", "k2"} {
+		if err := db.Put(key, "rotated "+key); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if len(db.segments) < 2 {
+		t.Fatalf("Expected the writer to rotate, got %d sealed segments", len(db.segments))
+	}
+	refresh()
+	for _, key := range []string{"k2", "k3", "k4", "k5"} {
+		expect(key, "rotated "+key)
+	}
+
+	// Compaction replaces the segments the reader knows about.
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if err := db.Put("k6", "v6"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	refresh()
+	for _, key := range []string{"k2", "k3", "k4", "k5"} {
+		expect(key, "rotated "+key)
+	}
+	expect("k1", "")
+	expect("k6", "v6")
+
+	files, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	if len(reader.segments) != len(files) {
+		t.Errorf("Expected the reader to know %d segments, got %d", len(files), len(reader.segments))
+	}
+}
+
+func TestRefreshIncompleteTail(t *testing.T) {
+	src := createTempDir(t)
+	defer os.RemoveAll(src)
+
+	db, err := Open(src)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	putEnd := db.currentOffset
+	var b Batch
+	b.Put("k1", "batched")
+	b.Put("k2", "batched")
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	segPath := db.currentSegment.Name()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	data, err := os.ReadFile(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay the segment into another directory the way a writer would
+	// append it, refreshing a reader at awkward points.
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, filepath.Base(segPath))
+	if err := os.WriteFile(path, data[:putEnd-5], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open db read-only: %v", err)
+	}
+	defer reader.Close()
+
+	written := putEnd - 5
+	appendUpTo := func(end int64) {
+		t.Helper()
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.Write(data[written:end]); err != nil {
+			t.Fatal(err)
+		}
+		written = end
+		if err := reader.Refresh(); err != nil {
+			t.Fatalf("Failed to refresh at offset %d: %v", end, err)
+		}
+	}
+
+	if _, err := reader.Get("k1"); err != ErrNotFound {
+		t.Errorf("Expected a half written record to be invisible, got %v", err)
+	}
+	appendUpTo(putEnd)
+	if value, err := reader.Get("k1"); err != nil || value != "v1" {
+		t.Errorf("Expected v1, got %q, %v", value, err)
+	}
+
+	// Everything but the last byte of the commit marker.
+	appendUpTo(int64(len(data)) - 1)
+	if value, err := reader.Get("k1"); err != nil || value != "v1" {
+		t.Errorf("Expected an uncommitted batch to be invisible, got %q, %v", value, err)
+	}
+	if _, err := reader.Get("k2"); err != ErrNotFound {
+		t.Errorf("Expected an uncommitted batch to be invisible, got %v", err)
+	}
+
+	appendUpTo(int64(len(data)))
+	for _, key := range []string{"k1", "k2"} {
+		if value, err := reader.Get(key); err != nil || value != "batched" {
+			t.Errorf("Expected %s = batched, got %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestRefreshFailureKeepsIndex(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{MaxSegmentSize: 100, CompactionThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	reader, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	defer reader.Close()
+
+	expectAll := func() {
+		t.Helper()
+		for _, key := range []string{"k1", "k2", "k3", "k4"} {
+			if value, err := reader.Get(key); err != nil || value != "value of "+key {
+				t.Errorf("Expected %s on the reader, got %q, %v", key, value, err)
+			}
+		}
+	}
+
+	paths, err := SegmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := len(reader.segments)
+	// Segments listed but compacted away before they were read: an older
+	// one makes the reader rebuild its index, newer ones are appended.
+	missing := func(ts string) string { return filepath.Join(dir, segmentPrefix+ts) }
+	for _, listed := range [][]string{
+		append([]string{missing("1")}, paths...),
+		append(slices.Clone(paths), missing("9000000000000000000"), missing("9000000000000000001")),
+	} {
+		reader.mu.Lock()
+		err := reader.refreshLocked(listed)
+		reader.mu.Unlock()
+		if err == nil {
+			t.Fatalf("Expected refreshing from %v to fail", listed)
+		}
+		if len(reader.segments) != known {
+			t.Errorf("Expected the reader to keep its %d segments, got %d", known, len(reader.segments))
+		}
+		expectAll()
+	}
+
+	if err := reader.Refresh(); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	expectAll()
+}
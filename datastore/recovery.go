@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+)
+
+// RecordError describes a damaged record found in a segment file.
+type RecordError struct {
+	Segment string
+	Offset  int64
+	Err     error
+}
+
+func (e RecordError) Error() string {
+	return fmt.Sprintf("segment %s at offset %d: %v", e.Segment, e.Offset, e.Err)
+}
+
+func (e RecordError) Unwrap() error {
+	return e.Err
+}
+
+// RecoveryReport describes the damage OpenRecover found and worked around.
+type RecoveryReport struct {
+	// BadRecords lists damaged records that were left out of the index.
+	BadRecords []RecordError
+	// TruncatedSegment is the segment whose torn tail was cut off, if any.
+	TruncatedSegment string
+	// TruncatedBytes is the number of bytes removed from TruncatedSegment.
+	TruncatedBytes int64
+}
+
+// OpenRecover opens the database like Open but tolerates damaged segments.
+// A torn tail of the newest segment, typically left by a crash mid-write,
+// is truncated away. Damaged records in older segments are skipped and
+// reported instead of failing the whole open. Options.Recover does the
+// same for OpenWithOptions.
+func OpenRecover(dir string) (*Db, *RecoveryReport, error) {
+	return openWithOptions(dir, Options{Recover: true})
+}
+
+// logRecovery logs the damage report shows was worked around.
+func (db *Db) logRecovery(report *RecoveryReport) {
+	for _, bad := range report.BadRecords {
+		db.logf("datastore: skipped damaged record: %v", bad)
+	}
+	if report.TruncatedSegment != "" {
+		db.logf("datastore: truncated %d bytes of torn tail from %s", report.TruncatedBytes, report.TruncatedSegment)
+	}
+}
+
+func (db *Db) recoverIndexLocked() (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+	db.resetIndexLocked()
+
+	for i, seg := range db.segments {
+		scan, err := scanSegment(seg.name, false)
+		if err != nil {
+			return nil, err
+		}
+
+		last := i == len(db.segments)-1
+		if last {
+			torn, err := truncateTornTail(seg.name, scan.end)
+			if err != nil {
+				return nil, err
+			}
+			if torn > 0 && len(scan.bad) > 0 {
+				report.TruncatedSegment = seg.name
+				report.TruncatedBytes = torn
+				// The damage past the cut is gone; keep only the bad
+				// records that were stepped over before it.
+				scan.bad = scan.bad[:len(scan.bad)-1]
+			}
+		}
+		report.BadRecords = append(report.BadRecords, scan.bad...)
+		db.mergeScanLocked(seg, scan)
+	}
+
+	return report, nil
+}
+
+// truncateTornTail cuts the segment at path down to end bytes and returns
+// how many bytes were removed.
+func truncateTornTail(path string, end int64) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	torn := info.Size() - end
+	if torn <= 0 {
+		return 0, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(end); err != nil {
+		return 0, err
+	}
+	return torn, file.Sync()
+}
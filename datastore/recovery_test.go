@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenRecoverTruncatesTornTail(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	segPath := db.currentSegment.Name()
+	goodSize := db.currentOffset
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	// Simulate a crash in the middle of writing the next record.
+	rec := NewStringRecord("k3", "v3")
+	data, err := rec.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(t, segPath, data[:len(data)/2])
+
+	if _, err := Open(dir); err == nil {
+		t.Fatalf("Expected Open to fail on a torn segment")
+	}
+
+	db, report, err := OpenRecover(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db in recovery mode: %v", err)
+	}
+	defer db.Close()
+
+	if report.TruncatedSegment != segPath {
+		t.Errorf("Expected %s to be truncated, got %q", segPath, report.TruncatedSegment)
+	}
+	if report.TruncatedBytes != int64(len(data)/2) {
+		t.Errorf("Expected %d truncated bytes, got %d", len(data)/2, report.TruncatedBytes)
+	}
+	if len(report.BadRecords) != 0 {
+		t.Errorf("Expected no bad records, got %v", report.BadRecords)
+	}
+
+	info, err := os.Stat(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != goodSize {
+		t.Errorf("Expected segment size %d after truncation, got %d", goodSize, info.Size())
+	}
+
+	for _, key := range []string{"k1", "k2"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Failed to get %s after recovery: %v", key, err)
+		}
+	}
+}
+
+func TestOpenWithOptionsRecover(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	segPath := db.currentSegment.Name()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	data, err := NewStringRecord("k2", "v2").Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(t, segPath, data[:len(data)/2])
+
+	logs := &bytes.Buffer{}
+	db, err = OpenWithOptions(dir, Options{Recover: true, Logger: log.New(logs, "", 0)})
+	if err != nil {
+		t.Fatalf("Failed to open db with Recover: %v", err)
+	}
+	defer db.Close()
+	if value, err := db.Get("k1"); err != nil || value != "v1" {
+		t.Errorf("Expected k1 = v1 after recovery, got %q, %v", value, err)
+	}
+	if !strings.Contains(logs.String(), "torn tail") {
+		t.Errorf("Expected the truncation to be logged, got %q", logs)
+	}
+}
+
+func TestOpenRecoverSkipsBadRecords(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	if err := db.Put("bad", "value"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("good", "value"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	oldSeg := db.currentSegment.Name()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	// Flip the last byte of the first record's value.
+	flipByte(t, oldSeg, int64(recordHeaderSize+seqSize+len("bad")+len("value")-1))
+
+	db, err = Open(dir)
+	if err == nil {
+		db.Close()
+		t.Fatalf("Expected Open to fail on a corrupted record")
+	}
+
+	// Write a newer segment so that the damaged one is not the last.
+	db, report, err := OpenRecover(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db in recovery mode: %v", err)
+	}
+	if err := db.Put("newer", "value"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+
+	db, report, err = OpenRecover(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen db in recovery mode: %v", err)
+	}
+	defer db.Close()
+
+	if len(report.BadRecords) != 1 {
+		t.Fatalf("Expected 1 bad record, got %v", report.BadRecords)
+	}
+	bad := report.BadRecords[0]
+	if bad.Segment != oldSeg || bad.Offset != 0 || !errors.Is(bad, ErrChecksum) {
+		t.Errorf("Unexpected bad record report: %v", bad)
+	}
+	if report.TruncatedSegment != "" {
+		t.Errorf("Expected no truncation, got %s", report.TruncatedSegment)
+	}
+
+	if _, err := db.Get("bad"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for damaged record, got %v", err)
+	}
+	for _, key := range []string{"good", "newer"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Failed to get %s after recovery: %v", key, err)
+		}
+	}
+}
+
+func TestOpenLegacySegment(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	segPath := filepath.Join(dir, segmentPrefix+"1")
+	data := encodeLegacyRecord(t, "old", "format")
+	if err := os.WriteFile(segPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db with legacy segment: %v", err)
+	}
+	defer db.Close()
+
+	value, err := db.Get("old")
+	if err != nil {
+		t.Fatalf("Failed to get legacy record: %v", err)
+	}
+	if value != "format" {
+		t.Errorf("Expected 'format', got %s", value)
+	}
+}
+
+func appendToFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,244 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+var (
+	// ErrNotReadOnly is returned by ApplyReplication on a writable Db: only
+	// a read-only Db can follow a leader.
+	ErrNotReadOnly = fmt.Errorf("database is not read-only")
+	// ErrDiverged is returned by ApplyReplication when the follower holds
+	// data the leader does not, so that it cannot simply catch up.
+	ErrDiverged = fmt.Errorf("follower has diverged from its leader")
+)
+
+// SegmentState is a segment file as far as it holds complete writes.
+type SegmentState struct {
+	// Name is the base name of the segment file.
+	Name string
+	Size int64
+}
+
+// ReplicationState is what a follower mirrors: the segment files of the
+// leader, oldest first, and the sequence number of the newest write in
+// them.
+type ReplicationState struct {
+	Segments []SegmentState
+	LastSeq  uint64
+}
+
+// LastSeq returns the sequence number of the newest write applied.
+func (db *Db) LastSeq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lastSeq
+}
+
+// ReplicationState describes the segment files of the database right now.
+func (db *Db) ReplicationState() ReplicationState {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	state := ReplicationState{LastSeq: db.lastSeq}
+	for _, seg := range db.segments {
+		var size int64
+		if u, ok := db.usage[seg.name]; ok {
+			size = u.size
+		}
+		if db.currentSegment == nil && seg == db.segments[len(db.segments)-1] {
+			size = db.tail
+		}
+		state.Segments = append(state.Segments, SegmentState{filepath.Base(seg.name), size})
+	}
+	if db.currentSegment != nil {
+		state.Segments = append(state.Segments, SegmentState{filepath.Base(db.currentSegment.Name()), db.currentOffset})
+	}
+	return state
+}
+
+// CopySegment writes the bytes [offset, offset+size) of the segment named
+// name, as listed by ReplicationState, to w. It fails with ErrNotFound once
+// compaction has removed the segment.
+func (db *Db) CopySegment(w io.Writer, name string, offset, size int64) error {
+	path := filepath.Join(db.dir, name)
+	db.mu.Lock()
+	known := slices.Contains(db.segments, segment{path}) ||
+		(db.currentSegment != nil && db.currentSegment.Name() == path)
+	if known {
+		db.pinSegmentsLocked()
+	}
+	db.mu.Unlock()
+	if !known {
+		return ErrNotFound
+	}
+	defer db.unpinSegments()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(w, io.NewSectionReader(file, offset, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ApplyReplication makes the segment files of a read-only Db match state,
+// the state of its leader, and refreshes the index. fetch writes the bytes
+// [offset, offset+size) of a leader segment to w. What was fetched before a
+// failure stays; calling ApplyReplication again picks up from there.
+//
+// The Db must be the only one following the leader in its directory, and
+// must not refresh on its own meanwhile: segments compacted away on the
+// leader are removed here, once no iterator, backup or change feed reads
+// them anymore.
+//
+// Hint files are not replicated. Whenever the leader compacts, the index
+// is rebuilt by scanning every segment the follower holds, which takes as
+// long as opening the database without hints.
+func (db *Db) ApplyReplication(state ReplicationState, fetch func(w io.Writer, name string, offset, size int64) error) error {
+	if !db.readOnly.Load() {
+		return ErrNotReadOnly
+	}
+
+	for _, seg := range state.Segments {
+		if err := db.catchUpSegment(seg, fetch); err != nil {
+			return err
+		}
+	}
+
+	paths, err := SegmentFiles(db.dir)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Removing compacted segments and refreshing go together, or the
+	// values they shadow in older segments would come back meanwhile.
+	wanted := make(map[string]bool)
+	for _, seg := range state.Segments {
+		wanted[filepath.Join(db.dir, seg.Name)] = true
+	}
+	var kept []string
+	var dropped []segment
+	for _, path := range paths {
+		if wanted[path] {
+			kept = append(kept, path)
+			continue
+		}
+		if db.dropped == nil {
+			db.dropped = make(map[string]bool)
+		}
+		db.dropped[path] = true
+		dropped = append(dropped, segment{path})
+	}
+	if err := db.refreshLocked(kept); err != nil {
+		// The index may still point into the dropped segments; the next
+		// call drops them again.
+		return err
+	}
+	db.retireSegmentsLocked(dropped)
+	return nil
+}
+
+// catchUpSegment brings the local copy of the leader segment seg up to its
+// size. A new segment is fetched under a temporary name, so that it only
+// shows up in the directory once complete.
+func (db *Db) catchUpSegment(seg SegmentState, fetch func(w io.Writer, name string, offset, size int64) error) error {
+	path := filepath.Join(db.dir, seg.Name)
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.Size() > seg.Size:
+		return fmt.Errorf("%w: %s holds %d bytes, the leader %d", ErrDiverged, seg.Name, info.Size(), seg.Size)
+	case err == nil && info.Size() == seg.Size:
+		return nil
+	case err == nil:
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if err := fetch(file, seg.Name, info.Size(), seg.Size-info.Size()); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	tmp := path + ".part"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, db.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	if err := fetch(file, seg.Name, 0, seg.Size); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Promote turns a read-only Db into a writable one, as when a follower
+// takes over from its leader. It takes the directory lock, so nothing else
+// may write to the directory anymore.
+func (db *Db) Promote() error {
+	if !db.readOnly.Load() {
+		return nil
+	}
+	db.stopRefresher()
+	defer db.startRefresher()
+	if err := db.Refresh(); err != nil {
+		return err
+	}
+
+	lock, err := lockDir(db.dir, db.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	db.stopSyncer()
+	db.stopCompactionScheduler()
+
+	db.mu.Lock()
+	if err := db.promoteLocked(); err != nil {
+		db.mu.Unlock()
+		lock.Close()
+		db.startSyncer()
+		db.startCompactionScheduler()
+		return err
+	}
+	db.lock = lock
+	db.readOnly.Store(false)
+	// Writers check readOnly before taking mu, so none of them can get
+	// past it before the syncer runs.
+	db.startSyncer()
+	db.mu.Unlock()
+	db.startCompactionScheduler()
+	return nil
+}
+
+func (db *Db) promoteLocked() error {
+	if len(db.segments) > 0 {
+		// Seal the tailed segment: whatever follows the last complete write
+		// would make it unreadable as a sealed segment.
+		last := db.segments[len(db.segments)-1]
+		if _, err := truncateTornTail(last.name, db.tail); err != nil {
+			return err
+		}
+		db.mmapSegment(last.name)
+	}
+	return db.createCurrentSegmentLocked()
+}
@@ -0,0 +1,251 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	leaderDir := createTempDir(t)
+	defer os.RemoveAll(leaderDir)
+	followerDir := leaderDir + "-follower"
+	if err := os.MkdirAll(followerDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	leader, err := OpenWithOptions(leaderDir, Options{MaxSegmentSize: 100, CompactionThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to open leader: %v", err)
+	}
+	follower, err := OpenWithOptions(followerDir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open follower: %v", err)
+	}
+	defer func() { follower.Close() }()
+
+	replicate := func() {
+		t.Helper()
+		fetch := func(w io.Writer, name string, offset, size int64) error {
+			return leader.CopySegment(w, name, offset, size)
+		}
+		if err := follower.ApplyReplication(leader.ReplicationState(), fetch); err != nil {
+			t.Fatalf("Failed to replicate: %v", err)
+		}
+		if follower.LastSeq() != leader.LastSeq() {
+			t.Errorf("Expected the follower at seq %d, got %d", leader.LastSeq(), follower.LastSeq())
+		}
+	}
+	expect := func(key, want string) {
+		t.Helper()
+		value, err := follower.Get(key)
+		if want == "" {
+			if err != ErrNotFound {
+				t.Errorf("Expected %s to be missing on the follower, got %q, %v", key, value, err)
+			}
+			return
+		}
+		if err != nil || value != want {
+			t.Errorf("Expected %s = %q on the follower, got %q, %v", key, want, value, err)
+		}
+	}
+
+	if err := leader.Put("k1", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	replicate()
+	expect("k1", "v1")
+
+	for _, key := range []string{"k2", "k3", "k4", "k2"} {
+		if err := leader.Put(key, "second "+key); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := leader.Delete("k1"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	replicate()
+	expect("k1", "")
+	expect("k2", "second k2")
+
+	if err := leader.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	replicate()
+	expect("k1", "")
+	for _, key := range []string{"k2", "k3", "k4"} {
+		expect(key, "second "+key)
+	}
+	if leaderFiles, followerFiles := baseNames(t, leaderDir), baseNames(t, followerDir); !slices.Equal(leaderFiles, followerFiles) {
+		t.Errorf("Expected the follower to mirror the leader segments %v, got %v", leaderFiles, followerFiles)
+	}
+
+	if err := follower.Put("k5", "v5"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly from the follower, got %v", err)
+	}
+	if err := leader.Close(); err != nil {
+		t.Fatalf("Failed to close leader: %v", err)
+	}
+	if err := follower.Promote(); err != nil {
+		t.Fatalf("Failed to promote: %v", err)
+	}
+	if err := follower.Put("k5", "v5"); err != nil {
+		t.Fatalf("Failed to put after promotion: %v", err)
+	}
+	if err := follower.ApplyReplication(ReplicationState{}, nil); err != ErrNotReadOnly {
+		t.Errorf("Expected ErrNotReadOnly, got %v", err)
+	}
+	if _, err := Open(followerDir); err != ErrLocked {
+		t.Errorf("Expected the promoted follower to hold the lock, got %v", err)
+	}
+
+	if err := follower.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	follower, err = Open(followerDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen the promoted follower: %v", err)
+	}
+	expect("k1", "")
+	expect("k2", "second k2")
+	expect("k5", "v5")
+}
+
+func baseNames(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := SegmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names
+}
+
+func TestReplicationKeepsPinnedSegments(t *testing.T) {
+	leaderDir := createTempDir(t)
+	defer os.RemoveAll(leaderDir)
+	followerDir := leaderDir + "-follower"
+	if err := os.MkdirAll(followerDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	leader, err := OpenWithOptions(leaderDir, Options{MaxSegmentSize: 100, CompactionThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to open leader: %v", err)
+	}
+	defer leader.Close()
+	follower, err := OpenWithOptions(followerDir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open follower: %v", err)
+	}
+	defer follower.Close()
+
+	fetch := func(w io.Writer, name string, offset, size int64) error {
+		return leader.CopySegment(w, name, offset, size)
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k1", "k2"} {
+		if err := leader.Put(key, "value "+key); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := follower.ApplyReplication(leader.ReplicationState(), fetch); err != nil {
+		t.Fatalf("Failed to replicate: %v", err)
+	}
+	before := baseNames(t, followerDir)
+
+	it := follower.NewIterator("", "")
+	if err := leader.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if err := follower.ApplyReplication(leader.ReplicationState(), fetch); err != nil {
+		t.Fatalf("Failed to replicate: %v", err)
+	}
+	if err := follower.Refresh(); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil || len(keys) != 3 {
+		t.Errorf("Expected the iterator to read 3 keys, got %v, %v", keys, err)
+	}
+	it.Close()
+
+	after := baseNames(t, followerDir)
+	if leaderFiles := baseNames(t, leaderDir); !slices.Equal(leaderFiles, after) {
+		t.Errorf("Expected the compacted segments %v to go once unpinned, got %v", before, after)
+	}
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if value, err := follower.Get(key); err != nil || value != "value "+key {
+			t.Errorf("Expected %s on the follower, got %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestReplicationFailureKeepsIndex(t *testing.T) {
+	leaderDir := createTempDir(t)
+	defer os.RemoveAll(leaderDir)
+	followerDir := leaderDir + "-follower"
+	if err := os.MkdirAll(followerDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	leader, err := OpenWithOptions(leaderDir, Options{MaxSegmentSize: 100, CompactionThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to open leader: %v", err)
+	}
+	defer leader.Close()
+	follower, err := OpenWithOptions(followerDir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open follower: %v", err)
+	}
+	defer follower.Close()
+
+	fetch := func(w io.Writer, name string, offset, size int64) error {
+		return leader.CopySegment(w, name, offset, size)
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k1", "k2"} {
+		if err := leader.Put(key, "value "+key); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := follower.ApplyReplication(leader.ReplicationState(), fetch); err != nil {
+		t.Fatalf("Failed to replicate: %v", err)
+	}
+	before := baseNames(t, followerDir)
+
+	if err := leader.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	// New segments arrive damaged, so the index cannot be rebuilt.
+	garbage := func(w io.Writer, name string, offset, size int64) error {
+		_, err := w.Write(bytes.Repeat([]byte{0xff}, int(size)))
+		return err
+	}
+	if err := follower.ApplyReplication(leader.ReplicationState(), garbage); err == nil {
+		t.Fatalf("Expected replicating damaged segments to fail")
+	}
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if value, err := follower.Get(key); err != nil || value != "value "+key {
+			t.Errorf("Expected %s on the follower, got %q, %v", key, value, err)
+		}
+	}
+	for _, name := range before {
+		if _, err := os.Stat(filepath.Join(followerDir, name)); err != nil {
+			t.Errorf("Expected %s, still in use, to stay: %v", name, err)
+		}
+	}
+}
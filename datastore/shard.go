@@ -0,0 +1,358 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// shardsFileName names the file recording the shard count of a sharded
+// data directory.
+const shardsFileName = "SHARDS"
+
+// ErrShardCount is returned by OpenShards when the data directory was
+// sharded differently; Reshard moves the keys to a new shard count.
+var ErrShardCount = fmt.Errorf("data directory has a different shard count")
+
+// ErrUnsharded is returned by OpenShards when the data directory holds the
+// segments of an unsharded database; Reshard splits them into shards.
+var ErrUnsharded = fmt.Errorf("data directory holds an unsharded database")
+
+// ShardOf returns which of n shards key belongs to.
+func ShardOf(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// ShardDir returns the data directory of shard i within dir.
+func ShardDir(dir string, i int) string {
+	return filepath.Join(dir, "shard-"+strconv.Itoa(i))
+}
+
+// ShardCount returns the number of shards dir is split into, or 0 if it is
+// not sharded.
+func ShardCount(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, shardsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid shard count in %s: %q", shardsFileName, data)
+	}
+	return n, nil
+}
+
+func writeShardCount(dir string, n int, perm os.FileMode) error {
+	path := filepath.Join(dir, shardsFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(n)+"\n"), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// OpenShards opens the n shards of the sharded data directory dir, each a
+// Db of its own in ShardDir(dir, i) opened with opts. A new directory is
+// set up for n shards; an existing one must have been sharded n ways or
+// OpenShards fails with ErrShardCount. A directory holding segments of its
+// own is an unsharded database and fails with ErrUnsharded.
+func OpenShards(dir string, n int, opts Options) ([]*Db, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid shard count %d", n)
+	}
+	count, err := ShardCount(dir)
+	if err != nil {
+		return nil, err
+	}
+	if segs, err := SegmentFiles(dir); err != nil {
+		return nil, err
+	} else if len(segs) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnsharded, dir)
+	}
+	switch {
+	case count == 0 && opts.ReadOnly:
+		return nil, fmt.Errorf("%s is not sharded", dir)
+	case count == 0:
+		if err := os.MkdirAll(dir, opts.withDefaults().DirMode); err != nil {
+			return nil, err
+		}
+		if err := writeShardCount(dir, n, opts.withDefaults().FileMode); err != nil {
+			return nil, err
+		}
+	case count != n:
+		return nil, fmt.Errorf("%w: %d, not %d", ErrShardCount, count, n)
+	}
+
+	shards := make([]*Db, n)
+	for i := range shards {
+		if opts.ReadOnly {
+			// Shards a writer has not used yet do not exist.
+			if err := os.MkdirAll(ShardDir(dir, i), opts.withDefaults().DirMode); err != nil {
+				closeShards(shards[:i])
+				return nil, err
+			}
+		}
+		shards[i], err = OpenWithOptions(ShardDir(dir, i), opts)
+		if err != nil {
+			closeShards(shards[:i])
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return shards, nil
+}
+
+func closeShards(shards []*Db) error {
+	var errs []error
+	for _, db := range shards {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ReshardReport describes what Reshard did.
+type ReshardReport struct {
+	// From is the shard count before, 1 for an unsharded database.
+	From, To int
+	// Moved is the number of keys copied to the shard they belong to now.
+	Moved int
+	// Removed is the number of keys deleted from shards they no longer
+	// belong to.
+	Removed int
+}
+
+// Reshard moves the keys of the data directory dir so that it is split
+// into n shards. Every shard is opened for writing, so nothing else may use
+// dir meanwhile. Keys are copied to their new shard, then the new count is
+// recorded, then the copies left in the old shards are deleted and shards
+// beyond n removed. An interrupted Reshard is completed by running it
+// again with the same n, also after the database has been used with the
+// new count in between.
+//
+// An unsharded database in dir is split the same way: its keys are copied
+// to the shards, and its segments are removed once the count is recorded.
+func Reshard(dir string, n int) (ReshardReport, error) {
+	report := ReshardReport{To: n}
+	if n <= 0 {
+		return report, fmt.Errorf("invalid shard count %d", n)
+	}
+	from, err := ShardCount(dir)
+	if err != nil {
+		return report, err
+	}
+	unsharded, err := SegmentFiles(dir)
+	if err != nil {
+		return report, err
+	}
+	if from == 0 && len(unsharded) == 0 {
+		return report, fmt.Errorf("%s is not sharded", dir)
+	}
+	report.From = max(from, 1)
+
+	if from != n {
+		// Shards numbered from on, if any, were left by a run to another
+		// count that was interrupted before recording it. Their copies may
+		// have been deleted or overwritten since, so they are started over.
+		if err := removeShardsFrom(dir, from); err != nil {
+			return report, err
+		}
+	}
+
+	// Shards beyond both counts may be left over by an interrupted run.
+	open := max(from, n)
+	for {
+		if _, err := os.Stat(ShardDir(dir, open)); err != nil {
+			break
+		}
+		open++
+	}
+	shards := make([]*Db, open)
+	for i := range shards {
+		if shards[i], err = Open(ShardDir(dir, i)); err != nil {
+			closeShards(shards[:i])
+			return report, fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	defer func() {
+		if shards != nil {
+			closeShards(shards)
+		}
+	}()
+
+	if from == 0 {
+		moved, err := splitUnsharded(dir, shards, n)
+		report.Moved += moved
+		if err != nil {
+			return report, err
+		}
+	}
+	if from != n {
+		for i, db := range shards[:from] {
+			moved, err := db.copyStrays(shards, i, n)
+			report.Moved += moved
+			if err != nil {
+				return report, fmt.Errorf("shard %d: %w", i, err)
+			}
+		}
+		if err := writeShardCount(dir, n, defaultFileMode); err != nil {
+			return report, err
+		}
+	}
+	if len(unsharded) > 0 {
+		// Every key of the unsharded database has its copy in a shard now.
+		// Opening it may have added a segment, so they are listed again.
+		if unsharded, err = SegmentFiles(dir); err != nil {
+			return report, err
+		}
+		if err := removeSegments(unsharded); err != nil {
+			return report, err
+		}
+	}
+
+	for i, db := range shards {
+		removed, err := db.deleteStrays(i, n)
+		report.Removed += removed
+		if err != nil {
+			return report, fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+
+	err = closeShards(shards)
+	shards = nil
+	if err != nil {
+		return report, err
+	}
+	for i := n; i < open; i++ {
+		if err := os.RemoveAll(ShardDir(dir, i)); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// removeShardsFrom removes the directories of the shards of dir numbered
+// from or higher.
+func removeShardsFrom(dir string, from int) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "shard-*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		i, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "shard-"))
+		if err != nil || i < from {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitUnsharded copies the keys of the unsharded database in dir to the
+// one of n shards each belongs to.
+func splitUnsharded(dir string, shards []*Db, n int) (int, error) {
+	db, err := Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	// No shard is numbered -1, so every key is copied.
+	moved, err := db.copyStrays(shards, -1, n)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return moved, err
+}
+
+// removeSegments removes the segment files at paths and their hint files.
+func removeSegments(paths []string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Remove(hintPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return syncDir(filepath.Dir(paths[0]))
+}
+
+// copyStrays copies the keys of db, shard i, that belong to another of n
+// shards over to it, keeping their expiry.
+func (db *Db) copyStrays(shards []*Db, i, n int) (int, error) {
+	it := db.NewIterator("", "")
+	defer it.Close()
+
+	moved := 0
+	for it.Next() {
+		target := ShardOf(it.Key(), n)
+		if target == i {
+			continue
+		}
+		entry, err := db.GetEntry(it.Key())
+		if errors.Is(err, ErrNotFound) {
+			// Expired since the iterator was made.
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+
+		rec, err := newValueRecord(entry.Key, entry.Value)
+		if err != nil {
+			return moved, err
+		}
+		if !entry.ExpiresAt.IsZero() {
+			rec.expiresAt = entry.ExpiresAt.UnixNano()
+		}
+		if err := shards[target].put(*rec); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, it.Err()
+}
+
+// deleteStrays deletes the keys of db, shard i, that belong to another of
+// n shards.
+func (db *Db) deleteStrays(i, n int) (int, error) {
+	it := db.NewIterator("", "")
+	var strays []string
+	for it.Next() {
+		if ShardOf(it.Key(), n) != i {
+			strays = append(strays, it.Key())
+		}
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, key := range strays {
+		err := db.Delete(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
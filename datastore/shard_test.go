@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOpenShards(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	shards, err := OpenShards(dir, 3, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := shards[ShardOf(key, 3)].Put(key, "value"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	for i, db := range shards {
+		if size, _ := db.Size(); size == 0 {
+			t.Errorf("Expected shard %d to hold some of the keys", i)
+		}
+	}
+	if err := closeShards(shards); err != nil {
+		t.Fatalf("Failed to close shards: %v", err)
+	}
+
+	if _, err := OpenShards(dir, 2, Options{}); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Expected ErrShardCount, got %v", err)
+	}
+	if n, err := ShardCount(dir); err != nil || n != 3 {
+		t.Errorf("Expected 3 shards, got %d, %v", n, err)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	const keys = 100
+	shards, err := OpenShards(dir, 2, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := shards[ShardOf(key, 2)].PutInt64(key, int64(i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := shards[ShardOf("ttl", 2)].PutWithTTL("ttl", "expiring", time.Hour); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	ttl, _ := shards[ShardOf("ttl", 2)].GetEntry("ttl")
+	if err := closeShards(shards); err != nil {
+		t.Fatalf("Failed to close shards: %v", err)
+	}
+
+	check := func(n int) {
+		t.Helper()
+		shards, err := OpenShards(dir, n, Options{})
+		if err != nil {
+			t.Fatalf("Failed to open %d shards: %v", n, err)
+		}
+		defer closeShards(shards)
+
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if value, err := shards[ShardOf(key, n)].GetInt64(key); err != nil || value != int64(i) {
+				t.Errorf("Expected %s = %d, got %d, %v", key, i, value, err)
+			}
+		}
+		entry, err := shards[ShardOf("ttl", n)].GetEntry("ttl")
+		if err != nil || !entry.ExpiresAt.Equal(ttl.ExpiresAt) {
+			t.Errorf("Expected ttl to keep its expiry %v, got %v, %v", ttl.ExpiresAt, entry.ExpiresAt, err)
+		}
+
+		total := 0
+		for _, db := range shards {
+			it := db.NewIterator("", "")
+			for it.Next() {
+				total++
+			}
+			it.Close()
+		}
+		if total != keys+1 {
+			t.Errorf("Expected every key exactly once, got %d keys", total)
+		}
+	}
+
+	report, err := Reshard(dir, 5)
+	if err != nil {
+		t.Fatalf("Failed to reshard: %v", err)
+	}
+	if report.From != 2 || report.Moved == 0 || report.Moved != report.Removed {
+		t.Errorf("Expected keys to move from 2 shards, got %+v", report)
+	}
+	check(5)
+
+	if report, err := Reshard(dir, 5); err != nil || report.Moved != 0 || report.Removed != 0 {
+		t.Errorf("Expected resharding again to do nothing, got %+v, %v", report, err)
+	}
+
+	if _, err := Reshard(dir, 1); err != nil {
+		t.Fatalf("Failed to reshard: %v", err)
+	}
+	check(1)
+	if _, err := os.Stat(ShardDir(dir, 1)); !os.IsNotExist(err) {
+		t.Errorf("Expected shards beyond the new count to be removed, got %v", err)
+	}
+}
+
+func TestReshardUnsharded(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	const keys = 20
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	if _, err := OpenShards(dir, 3, Options{}); !errors.Is(err, ErrUnsharded) {
+		t.Fatalf("Expected ErrUnsharded, got %v", err)
+	}
+
+	report, err := Reshard(dir, 3)
+	if err != nil {
+		t.Fatalf("Failed to reshard: %v", err)
+	}
+	if report.From != 1 || report.Moved != keys {
+		t.Errorf("Expected %d keys moved from 1 shard, got %+v", keys, report)
+	}
+	if segs, _ := SegmentFiles(dir); len(segs) != 0 {
+		t.Errorf("Expected the unsharded segments to be removed, got %v", segs)
+	}
+
+	shards, err := OpenShards(dir, 3, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	defer closeShards(shards)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if value, err := shards[ShardOf(key, 3)].Get(key); err != nil || value != "value" {
+			t.Errorf("Expected %s = value, got %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestReshardInterrupted(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// A key that stays in shard 0 of 2 but moves to shard 2 of 3.
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key-%d", i); ShardOf(k, 2) == 0 && ShardOf(k, 3) == 2 {
+			key = k
+		}
+	}
+
+	shards, err := OpenShards(dir, 2, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	if err := closeShards(shards); err != nil {
+		t.Fatalf("Failed to close shards: %v", err)
+	}
+
+	// An interrupted run to 3 shards left a copy of key in shard 2, and
+	// the key was deleted after it.
+	stale, err := Open(ShardDir(dir, 2))
+	if err != nil {
+		t.Fatalf("Failed to open shard: %v", err)
+	}
+	if err := stale.Put(key, "stale"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := stale.Close(); err != nil {
+		t.Fatalf("Failed to close shard: %v", err)
+	}
+
+	if _, err := Reshard(dir, 3); err != nil {
+		t.Fatalf("Failed to reshard: %v", err)
+	}
+	shards, err = OpenShards(dir, 3, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	defer closeShards(shards)
+	if value, err := shards[2].Get(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the stale copy of %s to be gone, got %q, %v", key, value, err)
+	}
+}
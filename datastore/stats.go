@@ -0,0 +1,165 @@
+package datastore
+
+import "slices"
+
+// segmentUsage tracks how much of a segment file the index still points
+// at. Everything else in the file is garbage compaction can reclaim.
+type segmentUsage struct {
+	size      int64
+	liveBytes int64
+	liveKeys  int
+}
+
+// sequenceMarkerSize is the size of the sequence marker compaction ends its
+// output with.
+const sequenceMarkerSize = recordHeaderSize + seqSize
+
+// deadRatio is the fraction of the segment compaction could reclaim. One
+// sequence marker's worth of dead bytes is left out: a segment holding just
+// the marker would otherwise be merged into another such segment forever.
+func (u *segmentUsage) deadRatio() float64 {
+	if u.size == 0 {
+		return 0
+	}
+	return float64(max(u.size-u.liveBytes-sequenceMarkerSize, 0)) / float64(u.size)
+}
+
+func (db *Db) usageLocked(seg segment) *segmentUsage {
+	u, ok := db.usage[seg.name]
+	if !ok {
+		u = &segmentUsage{}
+		db.usage[seg.name] = u
+	}
+	return u
+}
+
+// resetIndexLocked empties the index before it is rebuilt from disk.
+func (db *Db) resetIndexLocked() {
+	db.index = make(index)
+	db.usage = make(map[string]*segmentUsage)
+}
+
+// setIndexLocked points key at pos, moving the bytes of the position it
+// replaces to the garbage of their segment.
+func (db *Db) setIndexLocked(key string, pos recordPosition) {
+	db.deleteIndexLocked(key)
+	db.index[key] = pos
+	u := db.usageLocked(pos.segment)
+	u.liveBytes += pos.size
+	u.liveKeys++
+}
+
+// deleteIndexLocked removes key from the index, moving the bytes of its
+// record to the garbage of their segment.
+func (db *Db) deleteIndexLocked(key string) {
+	old, ok := db.index[key]
+	if !ok {
+		return
+	}
+	delete(db.index, key)
+	u := db.usageLocked(old.segment)
+	u.liveBytes -= old.size
+	u.liveKeys--
+}
+
+// dirtySegmentsLocked returns the sealed segments with at least the
+// GarbageRatio of dead bytes, oldest first.
+func (db *Db) dirtySegmentsLocked() []segment {
+	var dirty []segment
+	for _, seg := range db.segments {
+		if u, ok := db.usage[seg.name]; ok && u.deadRatio() >= db.opts.GarbageRatio {
+			dirty = append(dirty, seg)
+		}
+	}
+	return dirty
+}
+
+// SegmentStats describes how much of a segment file is still in use.
+type SegmentStats struct {
+	Path string
+	// Size is the size of the file; for the current segment, the bytes
+	// written so far.
+	Size int64
+	// LiveKeys and LiveBytes count the records the index points at.
+	// Expired records stay live until compaction drops them.
+	LiveKeys  int
+	LiveBytes int64
+}
+
+// DeadBytes is the space compaction would reclaim from the segment.
+func (s SegmentStats) DeadBytes() int64 {
+	return s.Size - s.LiveBytes
+}
+
+// Stats is a point-in-time summary of the space a Db uses.
+type Stats struct {
+	Keys      int
+	Size      int64
+	LiveBytes int64
+	// Segments lists the sealed segments oldest first, then the current
+	// one.
+	Segments []SegmentStats
+
+	// Compactions counts the compaction runs since Open, cancelled ones
+	// included, and CompactionFailures the ones that failed.
+	Compactions        int
+	CompactionFailures int
+	// LastCompaction is the latest run, nil if there was none.
+	LastCompaction *CompactionResult
+	// CompactionError is the error of the latest failed run, unless a run
+	// succeeded since.
+	CompactionError error
+}
+
+// DeadBytes is the space compaction would reclaim.
+func (s Stats) DeadBytes() int64 {
+	return s.Size - s.LiveBytes
+}
+
+// GarbageRatio is the fraction of Size taken by dead bytes.
+func (s Stats) GarbageRatio() float64 {
+	if s.Size == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes()) / float64(s.Size)
+}
+
+// Stats returns the live and dead bytes of every segment. It is kept up to
+// date as writes overwrite and delete keys and costs no disk access.
+func (db *Db) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	segs := slices.Clone(db.segments)
+	if db.currentSegment != nil {
+		segs = append(segs, segment{db.currentSegment.Name()})
+	}
+
+	stats := Stats{Keys: len(db.index)}
+	for _, seg := range segs {
+		var u segmentUsage
+		if found, ok := db.usage[seg.name]; ok {
+			u = *found
+		}
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Path:      seg.name,
+			Size:      u.size,
+			LiveKeys:  u.liveKeys,
+			LiveBytes: u.liveBytes,
+		})
+		stats.Size += u.size
+		stats.LiveBytes += u.liveBytes
+	}
+
+	c := &db.compaction
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats.Compactions = c.runs
+	stats.CompactionFailures = c.failures
+	if c.last != nil {
+		last := *c.last
+		stats.LastCompaction = &last
+	}
+	stats.CompactionError = c.lastErr
+	return stats
+}
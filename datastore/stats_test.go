@@ -0,0 +1,243 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, 100)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	// k1 is overwritten in the second segment, k2 stays live in the first.
+	for i, key := range []string{"k1", "k2", "k1", "k3"} {
+		if i == 2 {
+			db.mu.Lock()
+			if err := db.rotateSegmentLocked(); err != nil {
+				t.Fatalf("Failed to rotate segment: %v", err)
+			}
+			db.mu.Unlock()
+		}
+		if err := db.Put(key, "some value"); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+	if err := db.Delete("k3"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	stats := db.Stats()
+	if len(stats.Segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(stats.Segments))
+	}
+	sealed, current := stats.Segments[0], stats.Segments[1]
+	if sealed.LiveKeys != 1 || sealed.LiveBytes*2 != sealed.Size || sealed.DeadBytes() != sealed.LiveBytes {
+		t.Errorf("Expected half of the sealed segment live, got %+v", sealed)
+	}
+	// The overwrite of k1 is live, k3 and its tombstone are not.
+	if current.LiveKeys != 1 || current.Size != db.currentOffset || current.DeadBytes() <= current.LiveBytes {
+		t.Errorf("Expected one live record in the current segment, got %+v", current)
+	}
+	if stats.Keys != 2 || stats.Size != sealed.Size+current.Size || stats.DeadBytes() != sealed.DeadBytes()+current.DeadBytes() {
+		t.Errorf("Expected totals over both segments, got %+v", stats)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	db, err = open(dir, 1024, 100)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	// The accounting rebuilt from disk matches the one kept while writing.
+	reopened := db.Stats()
+	for i, s := range stats.Segments {
+		if reopened.Segments[i] != s {
+			t.Errorf("Segment %d: expected %+v after reopen, got %+v", i, s, reopened.Segments[i])
+		}
+	}
+}
+
+func TestCompactDirtySegments(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, 100)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	rotate := func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if err := db.rotateSegmentLocked(); err != nil {
+			t.Fatalf("Failed to rotate segment: %v", err)
+		}
+	}
+	put := func(key, value string) {
+		if err := db.Put(key, value); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	// Deleting gone leaves the first segment under the garbage ratio.
+	put("gone", "v")
+	put("kept", "a longer value")
+	rotate()
+	put("tmp", "v1")
+	put("tmp", "v2")
+	put("tmp", "v3")
+	if err := db.Delete("gone"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	rotate()
+	put("new", "v")
+	rotate()
+
+	db.mu.RLock()
+	before := append([]segment(nil), db.segments...)
+	dirty := db.dirtySegmentsLocked()
+	db.mu.RUnlock()
+	if len(dirty) != 1 || dirty[0] != before[1] {
+		t.Fatalf("Expected only the second segment to be dirty, got %v", dirty)
+	}
+	deadBefore := db.Stats().DeadBytes()
+
+	if err := db.compactSegments(context.Background(), dirty, 0); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	if len(db.segments) != 3 || db.segments[0] != before[0] || db.segments[2] != before[2] {
+		t.Fatalf("Expected only the dirty segment replaced, got %v", db.segments)
+	}
+	if db.segments[1] == before[1] {
+		t.Errorf("Expected the dirty segment to be rewritten")
+	}
+	if _, err := os.Stat(before[1].name); !os.IsNotExist(err) {
+		t.Errorf("Expected the dirty segment to be removed, got %v", err)
+	}
+	if dead := db.Stats().DeadBytes(); dead >= deadBefore {
+		t.Errorf("Expected compaction to reclaim space, dead bytes %d -> %d", deadBefore, dead)
+	}
+
+	// The first segment still holds "gone", so its tombstone must survive.
+	segIndex, err := getIndexFromPath(db.segments[1].name)
+	if err != nil {
+		t.Fatalf("Failed to read compacted segment: %v", err)
+	}
+	if pos, ok := segIndex["gone"]; !ok || !pos.tombstone {
+		t.Errorf("Expected the tombstone of gone to be kept")
+	}
+
+	check := func() {
+		t.Helper()
+		if _, err := db.Get("gone"); err != ErrNotFound {
+			t.Errorf("Expected gone to stay deleted, got %v", err)
+		}
+		for key, want := range map[string]string{"kept": "a longer value", "tmp": "v3", "new": "v"} {
+			if value, err := db.Get(key); err != nil || value != want {
+				t.Errorf("Expected %s=%s, got %q, %v", key, want, value, err)
+			}
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	db, err = open(dir, 1024, 100)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	check()
+
+	// Once nothing older is left out, the tombstone goes.
+	if err := db.compact(time.Now().UnixNano()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	segIndex, err = getIndexFromPath(db.segments[0].name)
+	if err != nil {
+		t.Fatalf("Failed to read compacted segment: %v", err)
+	}
+	if _, ok := segIndex["gone"]; ok {
+		t.Errorf("Expected a full compaction to drop the tombstone")
+	}
+	check()
+}
+
+func TestCompactionTriggeredByGarbage(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := Options{MaxSegmentSize: 100, CompactionThreshold: 2}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	// Distinct keys leave no garbage, however many segments they fill.
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	clean, err := SegmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clean) < 4 {
+		t.Fatalf("Expected the keys to fill several segments, got %d", len(clean))
+	}
+
+	db, err = OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	firstHot := db.currentSegment.Name()
+	for i := 0; i < 20; i++ {
+		if err := db.Put("hot", fmt.Sprintf("value%02d", i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	// Compaction runs in the background once two segments are dirty.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(firstHot); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the dirty segments to be compacted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, path := range clean {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected clean segment %s to be kept: %v", path, err)
+		}
+	}
+	if value, err := db.Get("hot"); err != nil || value != "value19" {
+		t.Errorf("Expected value19, got %q, %v", value, err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Expected key%d to survive: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// groupCommit coordinates the fsyncs of SyncGroup. The first writer to
+// arrive while no fsync runs becomes the leader and issues it on behalf of
+// everyone who queued up meanwhile; at most one fsync is in flight.
+type groupCommit struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// gathering is set while the leader delays its fsync; writers that
+	// arrive meanwhile are covered by it.
+	gathering bool
+	started   uint64
+	finished  uint64
+	// failed is the last fsync that failed, and failErr its error. A later
+	// fsync may succeed although the pages the failed one held were
+	// dropped, so it does not make their writes durable.
+	failed  uint64
+	failErr error
+
+	// waiting counts writers covered by the next fsync; full is closed
+	// when it reaches MaxSyncBatch so a delaying leader stops early.
+	waiting int
+	full    chan struct{}
+}
+
+// startSyncer prepares the flushing required by the sync mode.
+func (db *Db) startSyncer() {
+	db.syncStop = make(chan struct{})
+	db.syncDone = make(chan struct{})
+
+	mode := db.opts.Sync
+	if db.readOnly.Load() {
+		mode = SyncNone
+	}
+	switch mode {
+	case SyncGroup:
+		db.group.cond = sync.NewCond(&db.group.mu)
+		db.group.full = make(chan struct{})
+		close(db.syncDone)
+	case SyncPeriodic:
+		go db.periodicSyncLoop()
+	default:
+		close(db.syncDone)
+	}
+}
+
+// stopSyncer ends the background flushing, if any.
+func (db *Db) stopSyncer() {
+	close(db.syncStop)
+	<-db.syncDone
+}
+
+// waitSync blocks until the writes made so far are durable under the sync
+// mode. It must be called without holding mu.
+func (db *Db) waitSync() error {
+	if db.opts.Sync != SyncGroup {
+		return nil
+	}
+
+	g := &db.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Only an fsync started after our write covers it.
+	need := g.started + 1
+	g.waiting++
+	if g.waiting == db.opts.MaxSyncBatch {
+		close(g.full)
+	}
+
+	for g.finished < need {
+		if g.gathering || g.started != g.finished {
+			g.cond.Wait()
+			continue
+		}
+
+		g.gathering = true
+		full := g.full
+		g.mu.Unlock()
+		db.delaySync(full)
+		g.mu.Lock()
+		g.gathering = false
+
+		g.started++
+		n := g.started
+		g.waiting = 0
+		if isClosed(g.full) {
+			g.full = make(chan struct{})
+		}
+		g.mu.Unlock()
+
+		err := db.syncCurrentSegment()
+
+		g.mu.Lock()
+		g.finished = n
+		if err != nil {
+			g.failed = n
+			g.failErr = err
+		}
+		g.cond.Broadcast()
+	}
+	if need <= g.failed {
+		return g.failErr
+	}
+	return nil
+}
+
+// delaySync holds a group fsync back for up to MaxSyncDelay unless the
+// batch fills up first.
+func (db *Db) delaySync(full <-chan struct{}) {
+	if db.opts.MaxSyncDelay <= 0 {
+		return
+	}
+	timer := time.NewTimer(db.opts.MaxSyncDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-full:
+	case <-db.syncStop:
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (db *Db) periodicSyncLoop() {
+	defer close(db.syncDone)
+
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Nobody waits for this fsync; a failure resurfaces on the
+			// next one or when the segment is rotated.
+			_ = db.syncCurrentSegment()
+		case <-db.syncStop:
+			return
+		}
+	}
+}
+
+// fsync flushes a segment file to stable storage; tests replace it to
+// inject failures.
+var fsync = (*os.File).Sync
+
+// syncCurrentSegment fsyncs the segment writes are currently appended to.
+// The write lock is not held during the fsync so writers keep going.
+func (db *Db) syncCurrentSegment() error {
+	db.mu.RLock()
+	file := db.currentSegment
+	db.mu.RUnlock()
+
+	err := fsync(file)
+	if errors.Is(err, os.ErrClosed) {
+		// Rotation and Close sync a segment before closing it.
+		return nil
+	}
+	return err
+}
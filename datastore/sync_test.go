@@ -0,0 +1,195 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchWriters is the number of goroutines BenchmarkPutParallel writes
+// from, fixed so that the result does not depend on GOMAXPROCS.
+const benchWriters = 16
+
+// The group commit leader waits briefly for the others to queue up: with a
+// single P they rarely get to run while it blocks in fsync.
+var syncModes = []struct {
+	name string
+	opts Options
+}{
+	{"Always", Options{Sync: SyncAlways}},
+	{"Group", Options{Sync: SyncGroup, MaxSyncDelay: 20 * time.Microsecond, MaxSyncBatch: benchWriters}},
+	{"Periodic", Options{Sync: SyncPeriodic, SyncInterval: 10 * time.Millisecond}},
+	{"None", Options{Sync: SyncNone}},
+}
+
+func TestSyncModes(t *testing.T) {
+	for _, mode := range syncModes {
+		t.Run(mode.name, func(t *testing.T) {
+			dir := createTempDir(t)
+			defer os.RemoveAll(dir)
+
+			db, err := OpenWithOptions(dir, mode.opts)
+			if err != nil {
+				t.Fatalf("Failed to open db: %v", err)
+			}
+
+			const writers, perWriter = 8, 20
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < perWriter; i++ {
+						key := fmt.Sprintf("w%d-k%d", w, i)
+						if err := db.Put(key, key); err != nil {
+							t.Errorf("Failed to put %s: %v", key, err)
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			if err := db.Close(); err != nil {
+				t.Fatalf("Failed to close db: %v", err)
+			}
+
+			db, err = OpenWithOptions(dir, mode.opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen db: %v", err)
+			}
+			defer db.Close()
+
+			for w := 0; w < writers; w++ {
+				for i := 0; i < perWriter; i++ {
+					key := fmt.Sprintf("w%d-k%d", w, i)
+					if value, err := db.Get(key); err != nil || value != key {
+						t.Errorf("Expected %s, got %q, %v", key, value, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGroupCommitReportsFailedSync(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	const writers = 4
+	db, err := OpenWithOptions(dir, Options{
+		Sync: SyncGroup,
+		// The fsync waits until every writer has queued up for it.
+		MaxSyncDelay: time.Minute,
+		MaxSyncBatch: writers,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	injected := errors.New("injected fsync failure")
+	var calls atomic.Int32
+	fsync = func(file *os.File) error {
+		if calls.Add(1) == 1 {
+			return injected
+		}
+		return file.Sync()
+	}
+	defer func() { fsync = (*os.File).Sync }()
+
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			errs <- db.Put(fmt.Sprintf("k%d", w), "value")
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; !errors.Is(err, injected) {
+			t.Errorf("Expected every write covered by the failed fsync to fail, got %v", err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the writers to share one fsync, got %d", calls.Load())
+	}
+
+	// A write after the failure is covered by a new fsync.
+	db.opts.MaxSyncBatch = 1
+	if err := db.Put("after", "value"); err != nil {
+		t.Errorf("Expected a later write to succeed, got %v", err)
+	}
+}
+
+func TestGroupCommitAcrossRotation(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{
+		MaxSegmentSize:      256,
+		CompactionThreshold: 100,
+		Sync:                SyncGroup,
+		MaxSyncDelay:        5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				if err := db.Put(fmt.Sprintf("w%d-k%d", w, i), "value"); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(db.segments) == 0 {
+		t.Errorf("Expected the writes to rotate segments")
+	}
+}
+
+func BenchmarkPutParallel(b *testing.B) {
+	for _, mode := range syncModes {
+		b.Run(mode.name, func(b *testing.B) {
+			dir := createTempDir(b)
+			defer os.RemoveAll(dir)
+
+			db, err := OpenWithOptions(dir, mode.opts)
+			if err != nil {
+				b.Fatalf("Failed to open db: %v", err)
+			}
+			defer db.Close()
+
+			var counter atomic.Int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for w := 0; w < benchWriters; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						n := counter.Add(1)
+						if n > int64(b.N) {
+							return
+						}
+						key := fmt.Sprintf("key-%d", n%1000)
+						if err := db.Put(key, "value"); err != nil {
+							b.Errorf("Failed to put: %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
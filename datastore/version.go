@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by conditional writes whose
+// Precondition does not hold.
+var ErrPreconditionFailed = fmt.Errorf("precondition failed")
+
+// Entry is a stored value together with its metadata.
+type Entry struct {
+	Key   string
+	Value any
+	Type  DataType
+	// Seq is the sequence number of the write that stored the value. It
+	// grows with every write to the database, so it changes whenever the
+	// key is written again. Values written before sequence numbers were
+	// introduced have Seq 0.
+	Seq uint64
+	// ExpiresAt is the zero time for keys without a TTL.
+	ExpiresAt time.Time
+}
+
+func (rec *record) entry() Entry {
+	entry := Entry{
+		Key:   rec.key,
+		Value: rec.value,
+		Type:  rec.dataType,
+		Seq:   rec.seq,
+	}
+	if rec.expiresAt != 0 {
+		entry.ExpiresAt = time.Unix(0, rec.expiresAt)
+	}
+	return entry
+}
+
+// GetEntry returns the value of key along with its type and version.
+func (db *Db) GetEntry(key string) (Entry, error) {
+	rec := &record{}
+	if err := db.get(rec, key); err != nil {
+		return Entry{}, err
+	}
+	return rec.entry(), nil
+}
+
+// Precondition restricts a conditional write to particular versions of the
+// key, in the spirit of HTTP If-Match and If-None-Match. The zero value
+// always holds.
+type Precondition struct {
+	// MustExist and MustNotExist require the key to be present or absent.
+	MustExist    bool
+	MustNotExist bool
+	// IfMatch, when not empty, lists the sequence numbers the key may be
+	// at. A missing key matches none of them.
+	IfMatch []uint64
+	// IfNoneMatch lists the sequence numbers the key must not be at.
+	IfNoneMatch []uint64
+}
+
+func (p Precondition) holds(seq uint64, exists bool) bool {
+	switch {
+	case p.MustExist && !exists, p.MustNotExist && exists:
+		return false
+	case len(p.IfMatch) > 0 && (!exists || !slices.Contains(p.IfMatch, seq)):
+		return false
+	case exists && slices.Contains(p.IfNoneMatch, seq):
+		return false
+	default:
+		return true
+	}
+}
+
+// checkLocked reads the current version of key and checks pre against it.
+func (db *Db) checkLocked(key string, pre Precondition) error {
+	current := &record{}
+	err := db.getLocked(current, key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if !pre.holds(current.seq, exists) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// PutValueIf stores value under key like PutValue if pre holds, and
+// returns the sequence number of the write. A positive ttl makes the key
+// expire like PutWithTTL does.
+func (db *Db) PutValueIf(key string, value any, ttl time.Duration, pre Precondition) (uint64, error) {
+	rec, err := newValueRecord(key, value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl > 0 {
+		if err := rec.expireAfter(ttl); err != nil {
+			return 0, err
+		}
+	}
+
+	var seq uint64
+	err = db.commit(func() error {
+		if err := db.checkLocked(key, pre); err != nil {
+			return err
+		}
+
+		pos, err := db.writeLocked(*rec)
+		if err != nil {
+			return err
+		}
+		db.setIndexLocked(key, pos)
+		seq = db.lastSeq
+
+		return nil
+	})
+	return seq, err
+}
+
+// DeleteIf deletes key like Delete if pre holds.
+func (db *Db) DeleteIf(key string, pre Precondition) error {
+	return db.commit(func() error {
+		if err := db.checkLocked(key, pre); err != nil {
+			return err
+		}
+		return db.deleteLocked(key)
+	})
+}
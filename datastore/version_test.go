@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEntrySeq(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := open(dir, 1024, defaultCompactionThreshold)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+
+	if err := db.Put("k", "v1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	first, err := db.GetEntry("k")
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if err := db.Put("k", "v2"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	second, err := db.GetEntry("k")
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if first.Seq == 0 || second.Seq <= first.Seq {
+		t.Errorf("Expected increasing sequence numbers, got %d then %d", first.Seq, second.Seq)
+	}
+	if second.Value != "v2" || second.Type != DataTypeString {
+		t.Errorf("Unexpected entry %+v", second)
+	}
+
+	// The newest write is a tombstone compaction drops; its sequence
+	// number must not be handed out again.
+	if err := db.Put("gone", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Delete("gone"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	lastSeq := db.lastSeq
+	db.mu.Lock()
+	ts := time.Now().UnixNano()
+	if err := db.rotateSegmentLocked(); err != nil {
+		t.Fatalf("Failed to rotate segment: %v", err)
+	}
+	db.mu.Unlock()
+	if err := db.compact(ts); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close db: %v", err)
+	}
+	// Without the hint the sequence marker in the segment has to tell.
+	os.Remove(hintPath(db.segments[0].name))
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen db: %v", err)
+	}
+	defer db.Close()
+
+	if entry, err := db.GetEntry("k"); err != nil || entry.Seq != second.Seq {
+		t.Errorf("Expected seq %d to survive compaction, got %+v, %v", second.Seq, entry, err)
+	}
+	if err := db.Put("k", "v3"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if entry, _ := db.GetEntry("k"); entry.Seq <= lastSeq {
+		t.Errorf("Expected a seq above %d after reopen, got %d", lastSeq, entry.Seq)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.PutValueIf("k", "v", 0, Precondition{MustExist: true}); err != ErrPreconditionFailed {
+		t.Errorf("Expected ErrPreconditionFailed for a missing key, got %v", err)
+	}
+	seq, err := db.PutValueIf("k", "v1", 0, Precondition{MustNotExist: true})
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	if _, err := db.PutValueIf("k", "v", 0, Precondition{MustNotExist: true}); err != ErrPreconditionFailed {
+		t.Errorf("Expected ErrPreconditionFailed for an existing key, got %v", err)
+	}
+	if _, err := db.PutValueIf("k", "v", 0, Precondition{IfMatch: []uint64{seq + 100}}); err != ErrPreconditionFailed {
+		t.Errorf("Expected ErrPreconditionFailed for a stale seq, got %v", err)
+	}
+	if _, err := db.PutValueIf("k", "v", 0, Precondition{IfNoneMatch: []uint64{seq}}); err != ErrPreconditionFailed {
+		t.Errorf("Expected ErrPreconditionFailed for a matching If-None-Match, got %v", err)
+	}
+	newSeq, err := db.PutValueIf("k", int64(2), time.Hour, Precondition{IfMatch: []uint64{seq}})
+	if err != nil {
+		t.Fatalf("Failed to update with matching seq: %v", err)
+	}
+
+	entry, err := db.GetEntry("k")
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if entry.Seq != newSeq || entry.Value != int64(2) || entry.ExpiresAt.IsZero() {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+
+	if err := db.DeleteIf("k", Precondition{IfMatch: []uint64{seq}}); err != ErrPreconditionFailed {
+		t.Errorf("Expected ErrPreconditionFailed deleting a stale version, got %v", err)
+	}
+	if err := db.DeleteIf("k", Precondition{IfMatch: []uint64{newSeq}}); err != nil {
+		t.Errorf("Failed to delete the current version: %v", err)
+	}
+	if _, err := db.Get("k"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
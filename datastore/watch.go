@@ -0,0 +1,293 @@
+package datastore
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// subscriptionBuffer is the number of changes a subscriber may fall behind
+// by before it is cut off.
+const subscriptionBuffer = 256
+
+var (
+	// ErrSubscriptionLagged ends a subscription whose reader did not keep
+	// up with the writes. It can resume from the log with ReadChanges.
+	ErrSubscriptionLagged = fmt.Errorf("subscription fell too far behind")
+	// ErrChangesCompacted is returned by ReadChanges when compaction has
+	// rewritten part of the requested history, so that deletes and
+	// overwritten values in it may be gone.
+	ErrChangesCompacted = fmt.Errorf("changes were compacted away")
+)
+
+// Change is a write seen by a subscriber. A delete has Deleted set and
+// carries only the key and sequence number.
+type Change struct {
+	Entry
+	Deleted bool
+}
+
+func (rec *record) change() Change {
+	if rec.dataType == DataTypeTombstone {
+		return Change{Entry: Entry{Key: rec.key, Type: DataTypeTombstone, Seq: rec.seq}, Deleted: true}
+	}
+	return Change{Entry: rec.entry()}
+}
+
+// Subscription delivers the changes of keys with a given prefix in the
+// order they were written. Close must be called to stop it.
+type Subscription struct {
+	db     *Db
+	prefix string
+	// StartSeq is the sequence number of the newest write when the
+	// subscription was made. Every later matching write is delivered.
+	StartSeq uint64
+
+	c      chan Change
+	err    error
+	closed bool
+}
+
+// subscribers holds the open subscriptions of a Db.
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscribe starts delivering the changes of keys starting with prefix made
+// from now on. A subscriber that falls too far behind is cut off with
+// ErrSubscriptionLagged rather than slowing writers down; it can pick up
+// where it stopped through ReadChanges. Writes picked up by Refresh on a
+// read-only Db are not delivered.
+func (db *Db) Subscribe(prefix string) *Subscription {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	sub := &Subscription{
+		db:       db,
+		prefix:   prefix,
+		StartSeq: db.lastSeq,
+		c:        make(chan Change, subscriptionBuffer),
+	}
+	db.subscribers.mu.Lock()
+	defer db.subscribers.mu.Unlock()
+	if db.subscribers.subs == nil {
+		db.subscribers.subs = make(map[*Subscription]struct{})
+	}
+	db.subscribers.subs[sub] = struct{}{}
+	return sub
+}
+
+// Changes returns the channel changes are delivered on. It is closed when
+// the subscription ends.
+func (s *Subscription) Changes() <-chan Change {
+	return s.c
+}
+
+// Err reports why the subscription ended: ErrSubscriptionLagged or nil.
+func (s *Subscription) Err() error {
+	s.db.subscribers.mu.Lock()
+	defer s.db.subscribers.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) Close() {
+	s.db.subscribers.mu.Lock()
+	defer s.db.subscribers.mu.Unlock()
+	s.endLocked(nil)
+}
+
+func (s *Subscription) endLocked(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.c)
+	delete(s.db.subscribers.subs, s)
+}
+
+// publishLocked delivers the change made by rec, just written, to the
+// matching subscribers. It is called under the write lock, so changes go
+// out in sequence order.
+func (db *Db) publishLocked(rec *record) {
+	db.subscribers.mu.Lock()
+	defer db.subscribers.mu.Unlock()
+	if len(db.subscribers.subs) == 0 {
+		return
+	}
+
+	change := rec.change()
+	for sub := range db.subscribers.subs {
+		if !strings.HasPrefix(rec.key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.c <- change:
+		default:
+			sub.endLocked(ErrSubscriptionLagged)
+		}
+	}
+}
+
+// closeSubscriptions ends every subscription when the Db is closed.
+func (db *Db) closeSubscriptions() {
+	db.subscribers.mu.Lock()
+	defer db.subscribers.mu.Unlock()
+	for sub := range db.subscribers.subs {
+		sub.endLocked(nil)
+	}
+}
+
+// CheckChanges fails with ErrChangesCompacted if compaction has rewritten
+// changes with sequence numbers after after, so that ReadChanges could not
+// replay them. Compaction may still do so before a later ReadChanges.
+func (db *Db) CheckChanges(after uint64) error {
+	db.mu.Lock()
+	segs := slices.Clone(db.segments)
+	db.pinSegmentsLocked()
+	db.mu.Unlock()
+	defer db.unpinSegments()
+
+	return checkCompacted(segs, after)
+}
+
+// checkCompacted fails with ErrChangesCompacted if one of segs is a
+// compaction output holding changes after after.
+func checkCompacted(segs []segment, after uint64) error {
+	for _, seg := range segs {
+		if seq, ok := compactionMarker(seg.name); ok && seq > after {
+			return ErrChangesCompacted
+		}
+	}
+	return nil
+}
+
+// ReadChanges replays from the segment files the changes of keys starting
+// with prefix whose sequence numbers are in (after, upTo], oldest first.
+// Together with Subscription.StartSeq as upTo it fills the gap between a
+// position a subscriber reached earlier and a new subscription.
+//
+// The log only keeps every change until compaction rewrites it. If part of
+// the range has been compacted, ReadChanges fails with ErrChangesCompacted
+// before calling fn at all.
+func (db *Db) ReadChanges(prefix string, after, upTo uint64, fn func(Change) error) error {
+	db.mu.Lock()
+	segs := slices.Clone(db.segments)
+	limits := make([]int64, len(segs))
+	for i := range limits {
+		limits[i] = -1
+	}
+	if db.currentSegment != nil {
+		segs = append(segs, segment{db.currentSegment.Name()})
+		limits = append(limits, db.currentOffset)
+	} else if len(segs) > 0 {
+		// A read-only Db has only applied the newest segment this far.
+		limits[len(limits)-1] = db.tail
+	}
+	db.pinSegmentsLocked()
+	db.mu.Unlock()
+	defer db.unpinSegments()
+
+	if err := checkCompacted(segs, after); err != nil {
+		return err
+	}
+
+	for i, seg := range segs {
+		var changes []Change
+		err := walkCommitted(seg.name, limits[i], func(rec *record) {
+			if rec.seq > after && rec.seq <= upTo && strings.HasPrefix(rec.key, prefix) {
+				changes = append(changes, rec.change())
+			}
+		})
+		if err != nil {
+			return err
+		}
+		// Compaction outputs hold their records in no particular order,
+		// but still older than those of any later segment.
+		slices.SortFunc(changes, func(a, b Change) int {
+			return cmp.Compare(a.Seq, b.Seq)
+		})
+		for _, change := range changes {
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactionMarker returns the sequence number of the marker compaction
+// ends its output with, if the segment at path has one.
+func compactionMarker(path string) (uint64, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() < sequenceMarkerSize {
+		return 0, false
+	}
+
+	buf := make([]byte, sequenceMarkerSize)
+	if _, err := file.ReadAt(buf, info.Size()-sequenceMarkerSize); err != nil {
+		return 0, false
+	}
+	var rec record
+	if err := rec.Decode(buf); err != nil || rec.dataType != dataTypeSequence {
+		return 0, false
+	}
+	return rec.seq, true
+}
+
+// walkCommitted calls fn with the key records of the segment at path in the
+// order they were written, up to offset limit unless it is negative.
+// Records of a batch are passed on once its commit marker shows up.
+func walkCommitted(path string, limit int64, fn func(*record)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+	in := bufio.NewReader(r)
+	var batch []*record
+
+	for {
+		rec := &record{}
+		_, err := rec.DecodeFromReader(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("corrupted segment file %s: %w", path, err)
+		}
+
+		switch {
+		case rec.dataType == dataTypeSequence:
+		case rec.flags&flagBatch != 0:
+			batch = append(batch, rec)
+		case rec.dataType == dataTypeBatchCommit:
+			if count, _ := rec.value.(int64); count == int64(len(batch)) {
+				for _, pending := range batch {
+					fn(pending)
+				}
+			}
+			batch = nil
+		default:
+			batch = nil
+			fn(rec)
+		}
+	}
+}
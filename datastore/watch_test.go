@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("users/old", "before"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	sub := db.Subscribe("users/")
+	defer sub.Close()
+	if sub.StartSeq != 1 {
+		t.Errorf("Expected StartSeq 1, got %d", sub.StartSeq)
+	}
+
+	if err := db.Put("users/a", "1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.Put("orders/x", "ignored"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if _, err := db.IncrementInt64("users/count", 2); err != nil {
+		t.Fatalf("Failed to increment: %v", err)
+	}
+	var b Batch
+	b.Put("users/b", "2")
+	b.Delete("users/old")
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if err := db.Delete("users/a"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	expected := []Change{
+		{Entry: Entry{Key: "users/a", Value: "1", Type: DataTypeString, Seq: 2}},
+		{Entry: Entry{Key: "users/count", Value: int64(2), Type: DataTypeInt64, Seq: 4}},
+		{Entry: Entry{Key: "users/b", Value: "2", Type: DataTypeString, Seq: 5}},
+		{Entry: Entry{Key: "users/old", Type: DataTypeTombstone, Seq: 6}, Deleted: true},
+		{Entry: Entry{Key: "users/a", Type: DataTypeTombstone, Seq: 7}, Deleted: true},
+	}
+	for _, want := range expected {
+		got := <-sub.Changes()
+		if got != want {
+			t.Errorf("Expected change %+v, got %+v", want, got)
+		}
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Changes(); ok {
+		t.Errorf("Expected the channel to be closed")
+	}
+	if err := sub.Err(); err != nil {
+		t.Errorf("Expected no error after Close, got %v", err)
+	}
+}
+
+func TestSubscriptionLagged(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{Sync: SyncNone})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	sub := db.Subscribe("")
+	for i := 0; i <= subscriptionBuffer; i++ {
+		if err := db.Put("k", "v"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	received := 0
+	for range sub.Changes() {
+		received++
+	}
+	if received != subscriptionBuffer {
+		t.Errorf("Expected %d buffered changes, got %d", subscriptionBuffer, received)
+	}
+	if err := sub.Err(); err != ErrSubscriptionLagged {
+		t.Errorf("Expected ErrSubscriptionLagged, got %v", err)
+	}
+}
+
+func TestReadChanges(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenWithOptions(dir, Options{MaxSegmentSize: 100, CompactionThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a/1", "b/1", "a/2", "a/1", "b/2", "a/3"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := db.Delete("a/2"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if len(db.segments) == 0 {
+		t.Fatalf("Expected the changes to span several segments")
+	}
+
+	read := func(after, upTo uint64) ([]uint64, error) {
+		var seqs []uint64
+		err := db.ReadChanges("a/", after, upTo, func(c Change) error {
+			seqs = append(seqs, c.Seq)
+			return nil
+		})
+		return seqs, err
+	}
+
+	seqs, err := read(1, 7)
+	if err != nil {
+		t.Fatalf("Failed to read changes: %v", err)
+	}
+	if want := []uint64{3, 4, 6, 7}; !slices.Equal(seqs, want) {
+		t.Errorf("Expected seqs %v, got %v", want, seqs)
+	}
+	if seqs, _ := read(0, 4); !slices.Equal(seqs, []uint64{1, 3, 4}) {
+		t.Errorf("Expected seqs [1 3 4], got %v", seqs)
+	}
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if err := db.Put("a/4", "after compaction"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if _, err := read(1, 8); err != ErrChangesCompacted {
+		t.Errorf("Expected ErrChangesCompacted, got %v", err)
+	}
+	if err := db.CheckChanges(1); err != ErrChangesCompacted {
+		t.Errorf("Expected CheckChanges to report ErrChangesCompacted, got %v", err)
+	}
+	if err := db.CheckChanges(7); err != nil {
+		t.Errorf("Expected the changes after 7 to be available, got %v", err)
+	}
+	if seqs, err := read(7, 8); err != nil || !slices.Equal(seqs, []uint64{8}) {
+		t.Errorf("Expected seqs [8], got %v, %v", seqs, err)
+	}
+}
@@ -0,0 +1,96 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	leaderAddress   = "http://db:8070"
+	followerAddress = "http://db-follower:8070"
+)
+
+func TestReplication(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+
+	t.Run("FollowerCatchesUp", testFollowerCatchesUp)
+	t.Run("FollowerRejectsWrites", testFollowerRejectsWrites)
+	t.Run("FollowerReportsLag", testFollowerReportsLag)
+}
+
+func testFollowerCatchesUp(t *testing.T) {
+	key := fmt.Sprintf("replication-%d", time.Now().UnixNano())
+	resp, err := client.Post(leaderAddress+"/db/"+key, "application/json", strings.NewReader(`{"value":"replicated"}`))
+	if err != nil {
+		t.Fatalf("Failed to write to the leader: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 from the leader, got %d", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var value struct {
+			Value string `json:"value"`
+		}
+		status, err := getJSON(followerAddress+"/db/"+key, &value)
+		if err == nil && status == http.StatusOK && value.Value == "replicated" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower did not catch up: status %d, value %q, error %v", status, value.Value, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func testFollowerRejectsWrites(t *testing.T) {
+	resp, err := client.Post(followerAddress+"/db/rejected", "application/json", strings.NewReader(`{"value":"x"}`))
+	if err != nil {
+		t.Fatalf("Failed to reach the follower: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a write to the follower, got %d", resp.StatusCode)
+	}
+}
+
+func testFollowerReportsLag(t *testing.T) {
+	var status struct {
+		Role   string `json:"role"`
+		Leader string `json:"leader"`
+		Lag    uint64 `json:"lag"`
+		Error  string `json:"error"`
+	}
+	code, err := getJSON(followerAddress+"/admin/replication", &status)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("Failed to get replication status: status %d, error %v", code, err)
+	}
+	if status.Role != "follower" || status.Leader != leaderAddress {
+		t.Errorf("Expected a follower of %s, got %+v", leaderAddress, status)
+	}
+	if status.Error != "" {
+		t.Errorf("Expected no replication error, got %q", status.Error)
+	}
+	t.Logf("Follower lag: %d writes", status.Lag)
+}
+
+func getJSON(url string, v any) (int, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}